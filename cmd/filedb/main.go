@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/exonlabs/go-filedb/pkg/filedb"
+)
+
+const usage = `Usage: filedb [options] <command> [args]
+
+Commands:
+  ls [key]                 list keys and child collections
+  tree [key]               print collection tree
+  get <key>                print key value
+  set <key> [value]        set key value, read from stdin if not given
+  rm <key>                 delete key
+  cp [-r] [-f] <src> <dst> copy key, or child collection into dst with -r,
+                           existing dst key is overwritten with -f
+  mv [-r] [-f] <src> <dst> rename key, or child collection with -r,
+                           existing dst key is overwritten with -f
+  index ls [name]          list indexes, or keys marked in index name
+  index mark <name> <key>  mark key in index
+  index clear <name> <key> clear key from index
+  check [-repair] [-json]  check collection integrity
+  export [-format] [key]   write collection tree archive to stdout
+  import [-format] [-conflict] [key]
+                           read collection tree archive from stdin
+
+Options:
+`
+
+var (
+	dbPath      = flag.String("db", os.Getenv("FILEDB_PATH"), "collection path, defaults to $FILEDB_PATH")
+	secret      = flag.String("secret", "", "secret for encrypted values, values are decrypted and encrypted transparently")
+	aes256      = flag.Bool("aes256", false, "use AES-256 cipher with secret, default is AES-128")
+	checksum    = flag.Bool("checksum", false, "collection stores values as checksummed records")
+	legacyVals  = flag.Bool("legacy-values", false, "collection with checksum has headerless values")
+	journal     = flag.Bool("journal", false, "log key writes in journal")
+	backups     = flag.String("backup-policy", string(filedb.BackupOnSet), "backup policy, set, verify or none")
+	backupGens  = flag.Int("backup-generations", 0, "number of backup generations kept")
+	keyEncoding = flag.Bool("key-encoding", false, "collection uses key encoding")
+	legacyBaks  = flag.Bool("legacy-backups", false, "collection has backups of legacy key_bak layout")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || *dbPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dbc, err := openCollection()
+	if err == nil {
+		err = run(dbc, flag.Arg(0), flag.Args()[1:])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", strings.TrimSpace(err.Error()))
+		os.Exit(1)
+	}
+}
+
+func openCollection() (*filedb.Collection, error) {
+	dbc, err := filedb.NewCollection(*dbPath)
+	if err != nil {
+		return nil, err
+	}
+	err = dbc.UpdateOptions(filedb.Options{
+		"checksum":           *checksum,
+		"legacy_values":      *legacyVals,
+		"journal":            *journal,
+		"backup_policy":      *backups,
+		"backup_generations": *backupGens,
+		"key_encoding":       *keyEncoding,
+		"legacy_backups":     *legacyBaks,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if *secret != "" {
+		if *aes256 {
+			err = dbc.InitAES256(*secret)
+		} else {
+			err = dbc.InitAES128(*secret)
+		}
+	}
+	return dbc, err
+}
+
+func run(dbc *filedb.Collection, cmd string, args []string) error {
+	switch cmd {
+	case "ls":
+		return cmdList(dbc, args)
+	case "tree":
+		return cmdTree(dbc, args)
+	case "get":
+		return cmdGet(dbc, args)
+	case "set":
+		return cmdSet(dbc, args)
+	case "rm":
+		return cmdRemove(dbc, args)
+	case "cp", "mv":
+		return cmdCopy(dbc, cmd, args)
+	case "index":
+		return cmdIndex(dbc, args)
+	case "check":
+		return cmdCheck(dbc, args)
+	case "export":
+		return cmdExport(dbc, args)
+	case "import":
+		return cmdImport(dbc, args)
+	}
+	return fmt.Errorf("unknown command: %s", cmd)
+}
+
+// check args count is between min and max
+func checkArgs(args []string, min, max int) error {
+	if len(args) < min || len(args) > max {
+		return errors.New("invalid arguments, see -h for usage")
+	}
+	return nil
+}
+
+// get child collection for optional key arg
+func childCollection(dbc *filedb.Collection, args []string) *filedb.Collection {
+	if len(args) > 0 && args[0] != "" {
+		return dbc.Child(args[0])
+	}
+	return dbc
+}
+
+func cmdList(dbc *filedb.Collection, args []string) error {
+	if err := checkArgs(args, 0, 1); err != nil {
+		return err
+	}
+	c := childCollection(dbc, args)
+	childs, err := c.ListChilds()
+	if err != nil {
+		return err
+	}
+	keys, err := c.Query().Keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range childs {
+		fmt.Println(k + "/")
+	}
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+	return nil
+}
+
+func cmdTree(dbc *filedb.Collection, args []string) error {
+	if err := checkArgs(args, 0, 1); err != nil {
+		return err
+	}
+	c := childCollection(dbc, args)
+	fmt.Println(c)
+	return printTree(c, "")
+}
+
+func printTree(dbc *filedb.Collection, indent string) error {
+	childs, err := dbc.ListChilds()
+	if err != nil {
+		return err
+	}
+	keys, err := dbc.Query().Keys()
+	if err != nil {
+		return err
+	}
+	for i, k := range childs {
+		last := i == len(childs)-1 && len(keys) == 0
+		fmt.Println(indent + treeBranch(last) + k + "/")
+		if err := printTree(dbc.Child(k), indent+treeIndent(last)); err != nil {
+			return err
+		}
+	}
+	for i, k := range keys {
+		fmt.Println(indent + treeBranch(i == len(keys)-1) + k)
+	}
+	return nil
+}
+
+func treeBranch(last bool) string {
+	if last {
+		return "└── "
+	}
+	return "├── "
+}
+
+func treeIndent(last bool) string {
+	if last {
+		return "    "
+	}
+	return "│   "
+}
+
+func cmdGet(dbc *filedb.Collection, args []string) error {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return err
+	}
+	value, err := getValue(dbc.Query(), args[0])
+	if err != nil {
+		return err
+	}
+	return printValue(value)
+}
+
+func cmdSet(dbc *filedb.Collection, args []string) error {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return err
+	}
+	var value []byte
+	if len(args) == 2 {
+		value = []byte(args[1])
+	} else {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = b
+	}
+	if *secret != "" {
+		return dbc.Query().SetSecure(args[0], value)
+	}
+	return dbc.Query().Set(args[0], value)
+}
+
+func cmdRemove(dbc *filedb.Collection, args []string) error {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return err
+	}
+	return dbc.Query().Delete(args[0])
+}
+
+func cmdCopy(dbc *filedb.Collection, cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	recursive := fs.Bool("r", false, "copy or move child collection")
+	overwrite := fs.Bool("f", false, "overwrite existing destination key")
+	fs.Parse(args)
+	if err := checkArgs(fs.Args(), 2, 2); err != nil {
+		return err
+	}
+	src, dst := fs.Arg(0), fs.Arg(1)
+
+	opts := filedb.Options{"overwrite": *overwrite}
+	switch {
+	case cmd == "cp" && *recursive:
+		return dbc.Copy(src, dst)
+	case cmd == "cp":
+		return dbc.Query().CopyKey(src, dbc, dst, opts)
+	case *recursive:
+		return dbc.Rename(src, dst)
+	}
+	return dbc.Query().RenameKey(src, dst, opts)
+}
+
+func cmdIndex(dbc *filedb.Collection, args []string) error {
+	if err := checkArgs(args, 1, 3); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "ls":
+		if err := checkArgs(args, 1, 2); err != nil {
+			return err
+		}
+		var res []string
+		var err error
+		if len(args) == 1 {
+			res, err = dbc.ListIndexes()
+		} else {
+			res, err = dbc.Index(args[1]).List()
+		}
+		if err != nil {
+			return err
+		}
+		for _, k := range res {
+			fmt.Println(k)
+		}
+		return nil
+	case "mark":
+		if err := checkArgs(args, 3, 3); err != nil {
+			return err
+		}
+		return dbc.Index(args[1]).Mark(args[2])
+	case "clear":
+		if err := checkArgs(args, 3, 3); err != nil {
+			return err
+		}
+		return dbc.Index(args[1]).Clear(args[2])
+	}
+	return fmt.Errorf("unknown index command: %s", args[0])
+}
+
+func cmdCheck(dbc *filedb.Collection, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "repair found issues")
+	jsonValues := fs.Bool("json", false, "check values are valid json")
+	fs.Parse(args)
+
+	report, err := dbc.Check(filedb.Options{
+		"repair": *repair,
+		"json":   *jsonValues,
+		"secure": *secret != "",
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	if !report.OK() {
+		return errors.New("integrity issues found")
+	}
+	return nil
+}
+
+func cmdExport(dbc *filedb.Collection, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", filedb.ExportNDJSON, "archive format, tar or ndjson")
+	noIndexes := fs.Bool("no-indexes", false, "exclude indexes")
+	fs.Parse(args)
+	if err := checkArgs(fs.Args(), 0, 1); err != nil {
+		return err
+	}
+	return childCollection(dbc, fs.Args()).Export(os.Stdout, filedb.Options{
+		"format":  *format,
+		"indexes": !*noIndexes,
+		"decrypt": *secret != "",
+	})
+}
+
+func cmdImport(dbc *filedb.Collection, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", filedb.ExportNDJSON, "archive format, tar or ndjson")
+	conflict := fs.String("conflict", filedb.ConflictFail, "policy for existing keys, skip, overwrite or fail")
+	fs.Parse(args)
+	if err := checkArgs(fs.Args(), 0, 1); err != nil {
+		return err
+	}
+	return childCollection(dbc, fs.Args()).Import(os.Stdin, filedb.Options{
+		"format":   *format,
+		"conflict": *conflict,
+		"encrypt":  *secret != "",
+	})
+}
+
+// read key value decrypting it if secret is set
+func getValue(dbq *filedb.Query, key string) ([]byte, error) {
+	if *secret != "" {
+		return dbq.GetSecure(key)
+	}
+	return dbq.Get(key)
+}
+
+// print value, json values are pretty printed
+func printValue(value []byte) error {
+	if json.Valid(value) {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, value, "", "  "); err == nil {
+			value = buf.Bytes()
+		}
+	}
+	if _, err := os.Stdout.Write(value); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(value, []byte("\n")) {
+		fmt.Println()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// run command with flags capturing its output
+func runCommand(t *testing.T, flags map[string]string, args ...string) (string, error) {
+	t.Helper()
+	for name, value := range flags {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		defer flag.Set(name, flag.Lookup(name).DefValue)
+	}
+	dbc, err := openCollection()
+	if err != nil {
+		return "", err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = run(dbc, args[0], args[1:])
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out), err
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	flag.Set("db", dir)
+	opts := map[string]string{"checksum": "true", "backup-generations": "2"}
+
+	tests := []struct {
+		args []string
+		out  string
+		err  bool
+	}{
+		{[]string{"set", "a", "1"}, "", false},
+		{[]string{"set", "c.k", `{"x":1}`}, "", false},
+		{[]string{"get", "a"}, "1\n", false},
+		{[]string{"get", "c.k"}, "{\n  \"x\": 1\n}\n", false},
+		{[]string{"ls"}, "c/\na\n", false},
+		{[]string{"tree"}, "<Collection: " + dir + ">\n├── c/\n│   └── k\n└── a\n", false},
+		{[]string{"cp", "a", "b"}, "", false},
+		{[]string{"mv", "b", "a"}, "", true},
+		{[]string{"mv", "-f", "b", "a"}, "", false},
+		{[]string{"index", "mark", "ix", "a"}, "", false},
+		{[]string{"index", "ls", "ix"}, "a\n", false},
+		{[]string{"rm", "a"}, "", false},
+		{[]string{"get", "a"}, "", true},
+		{[]string{"unknown"}, "", true},
+	}
+	for _, tt := range tests {
+		out, err := runCommand(t, opts, tt.args...)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: unexpected error %v", tt.args, err)
+		}
+		if out != tt.out {
+			t.Errorf("%v: expected output %q, got %q", tt.args, tt.out, out)
+		}
+	}
+
+	// check reads records with the collection options
+	out, err := runCommand(t, opts, "check")
+	if err != nil || !strings.Contains(out, `"keys": 1`) {
+		t.Errorf("unexpected check result %s %v", out, err)
+	}
+	// invalid options are rejected
+	if _, err := runCommand(t, map[string]string{"backup-policy": "x"}, "ls"); err == nil {
+		t.Error("expected invalid backup policy error")
+	}
+}
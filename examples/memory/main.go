@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/exonlabs/go-filedb/pkg/filedb"
+)
+
+func main() {
+	dbc, _ := filedb.NewCollection("/filedb")
+	dbc.InitStorage(filedb.NewMemStorage())
+
+	fmt.Printf("\nUsing Memory Database: %s\n", dbc)
+
+	fmt.Println("\nTesting Write ...")
+	dbq := dbc.Query()
+	for _, k := range []string{
+		"a.1.11", "a.1.12", "a.2.21", "b.1.11", "c.1.11"} {
+		if err := dbq.Set(k, []byte{0, 1, 2, 3}); err != nil {
+			fmt.Println("Error:", err.Error())
+			return
+		}
+	}
+
+	fmt.Println("\nTesting Read ...")
+	for _, k := range []string{
+		"a.1.11", "a.1.12", "a.2.21", "b.1.11", "c.1.11"} {
+		if b, err := dbq.Get(k); err != nil {
+			fmt.Println("Error:", err.Error())
+			return
+		} else {
+			fmt.Printf("%s = %v\n", k, b)
+		}
+	}
+
+	fmt.Println("\nList Childs ...")
+	res, err := dbc.ListChilds()
+	fmt.Println(res, err)
+
+	fmt.Println("\nTesting Copy ...")
+	err = dbc.Copy("a", "c")
+	fmt.Println(err)
+	res, err = dbc.Child("c").ListChilds()
+	fmt.Println(res, err)
+
+	fmt.Println()
+}
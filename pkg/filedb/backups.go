@@ -0,0 +1,289 @@
+package filedb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backup files are stored in a hidden ".bak" dir next to the key files,
+// outside the key namespace. the backup of key is stored with the key
+// file name and backup generations keep the previous values as files
+// named name.1 (newest) to name.N (oldest), rotated on every Set.
+//
+// the legacy layout stored backups as siblings named key_bak and
+// generations as key_bak.N. with the legacy_backups option, legacy
+// backups are used on reads and removed on writes, keys ending with
+// "_bak" are rejected and MigrateBackups converts them.
+
+// list available backup generations of key, sorted from newest
+func (dbq *Query) ListGenerations(key string) ([]int, error) {
+	if err := dbq.collection.checkKey(key); err != nil {
+		return nil, err
+	}
+	return dbq.keyGenerations(dbq.collection.keyPath(key))
+}
+
+// list available backup generations of key file
+func (dbq *Query) keyGenerations(keypath string) ([]int, error) {
+	keybakpath := keyBakPath(keypath)
+	entries, err := dbq.storage.ReadDir(filepath.Dir(keybakpath))
+	if err != nil {
+		if dbq.FileExist(keypath) {
+			return []int{}, nil
+		}
+		return nil, ErrNotExist
+	}
+
+	prefix := filepath.Base(keybakpath) + keySep
+	res := []int{}
+	for _, e := range entries {
+		n, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		if gen, err := strconv.Atoi(n); err == nil && gen > 0 {
+			res = append(res, gen)
+		}
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+// read the value stored in backup generation of key
+func (dbq *Query) GetGeneration(key string, gen int) ([]byte, error) {
+	if err := dbq.collection.checkKey(key); err != nil {
+		return nil, err
+	}
+	genpath := dbq.genPath(key, gen)
+	if !dbq.FileExist(genpath) {
+		return nil, ErrNotExist
+	}
+	rawdata, err := dbq.ReadFile(genpath)
+	if err != nil {
+		return nil, err
+	}
+	payload, _, err := dbq.collection.decodeValue(rawdata)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// restore key value from backup generation, the current value is
+// rotated into generations like a normal Set
+func (dbq *Query) RestoreGeneration(key string, gen int) error {
+	if err := dbq.collection.checkKey(key); err != nil {
+		return err
+	}
+	genpath := dbq.genPath(key, gen)
+	if !dbq.FileExist(genpath) {
+		return ErrNotExist
+	}
+	rawdata, err := dbq.ReadFile(genpath)
+	if err != nil {
+		return err
+	}
+	if _, _, err := dbq.collection.decodeValue(rawdata); err != nil {
+		return err
+	}
+	return dbq.write(key, rawdata)
+}
+
+// get backup file path for key
+func (dbq *Query) bakPath(key string) string {
+	return keyBakPath(dbq.collection.keyPath(key))
+}
+
+// get backup file path of key file
+func keyBakPath(keypath string) string {
+	return filepath.Join(
+		filepath.Dir(keypath), bakDir, filepath.Base(keypath))
+}
+
+// get legacy backup file path of key file
+func legacyBakPath(keypath string) string {
+	return keypath + keyBakSuffix
+}
+
+// remove legacy backup file of key file in legacy backups mode
+func (dbq *Query) purgeLegacyBackup(keypath string) error {
+	if !dbq.collection.legacyBackups {
+		return nil
+	}
+	if p := legacyBakPath(keypath); dbq.FileExist(p) {
+		return dbq.PurgeFile(p)
+	}
+	return nil
+}
+
+// check if file name is a legacy backup name in legacy backups mode
+func (dbc *Collection) isLegacyBak(name string) bool {
+	if !dbc.legacyBackups || dbc.keyEncoding {
+		return false
+	}
+	_, ok := legacyBakName(name)
+	return ok
+}
+
+// get backup generation file path for key
+func (dbq *Query) genPath(key string, gen int) string {
+	return keyGenPath(dbq.collection.keyPath(key), gen)
+}
+
+// get backup generation file path of key file
+func keyGenPath(keypath string, gen int) string {
+	return keyBakPath(keypath) + keySep + strconv.Itoa(gen)
+}
+
+// shift backup generations and save current key content as newest,
+// generations are renumbered from 2 closing gaps left by interrupted
+// rotations and the oldest beyond the limit are removed. must be called
+// holding the key dir lock.
+func (dbq *Query) rotateGenerations(key, keypath string) error {
+	rawdata, err := dbq.ReadFile(keypath)
+	if err != nil {
+		return err
+	}
+
+	n := dbq.collection.backupGenerations
+	gens, err := dbq.ListGenerations(key)
+	if err != nil {
+		return err
+	}
+	for len(gens) >= n {
+		dbq.PurgeFile(dbq.genPath(key, gens[len(gens)-1]))
+		gens = gens[:len(gens)-1]
+	}
+
+	// generations moving down are renamed from the newest and those
+	// moving up from the oldest, so no generation is overwritten before
+	// it is renamed. generations already removed are skipped.
+	move := func(i int) error {
+		if gens[i] == i+2 {
+			return nil
+		}
+		err := dbq.storage.Rename(
+			dbq.genPath(key, gens[i]), dbq.genPath(key, i+2))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+		}
+		return nil
+	}
+	k := 0
+	for k < len(gens) && gens[k] == k+1 {
+		k++
+	}
+	for i := k; i < len(gens); i++ {
+		if err := move(i); err != nil {
+			return err
+		}
+	}
+	for i := k - 1; i >= 0; i-- {
+		if err := move(i); err != nil {
+			return err
+		}
+	}
+	return dbq.WriteFile(dbq.genPath(key, 1), rawdata)
+}
+
+// delete backup file and all backup generations of key file
+func (dbq *Query) purgeBackups(keypath string) error {
+	gens, _ := dbq.keyGenerations(keypath)
+	for _, gen := range gens {
+		if err := dbq.PurgeFile(keyGenPath(keypath, gen)); err != nil {
+			return err
+		}
+	}
+	if keybakpath := keyBakPath(keypath); dbq.FileExist(keybakpath) {
+		if err := dbq.PurgeFile(keybakpath); err != nil {
+			return err
+		}
+	}
+	return dbq.purgeLegacyBackup(keypath)
+}
+
+// move legacy backup files of collection and its child collections and
+// indexes into backup dirs, the collection is locked exclusively while
+// files are moved. backups already in the new layout are kept. requires
+// the legacy_backups option.
+func (dbc *Collection) MigrateBackups() (err error) {
+	defer dbc.logOp("migrate_backups", time.Now(), &err)
+
+	if dbc.keyErr != nil {
+		return dbc.keyErr
+	}
+	if !dbc.legacyBackups {
+		return fmt.Errorf(
+			"%wmigrate backups requires legacy_backups option", ErrError)
+	}
+	if !dbc.IsExist() {
+		return nil
+	}
+	return dbc.withTreeLock(dbc.Query().FileEngine, func(dbq *Query) error {
+		return dbc.migrateBackups(dbq, dbc.base_path)
+	})
+}
+
+func (dbc *Collection) migrateBackups(dbq *Query, dirpath string) error {
+	if dbc.ctx.Err() != nil {
+		return ctxError(dbc.ctx)
+	}
+	entries, err := dbc.storage.ReadDir(dirpath)
+	if err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+
+	dirs := []string{}
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			if !strings.HasPrefix(n, ".") || strings.HasPrefix(n, ".ix_") {
+				dirs = append(dirs, filepath.Join(dirpath, n))
+			}
+			continue
+		}
+		name, ok := legacyBakName(n)
+		if !e.Type().IsRegular() || !ok {
+			continue
+		}
+		oldpath := filepath.Join(dirpath, n)
+		newpath := filepath.Join(dirpath, bakDir, name)
+		if dbq.FileExist(newpath) {
+			err = dbq.PurgeFile(oldpath)
+		} else if err = dbc.storage.MkdirAll(filepath.Dir(newpath),
+			os.FileMode(dbq.DirPerm)); err == nil {
+			err = dbc.storage.Rename(oldpath, newpath)
+		}
+		if err != nil {
+			return fmt.Errorf("%w%s", ErrError, err.Error())
+		}
+	}
+
+	for _, d := range dirs {
+		if err := dbc.migrateBackups(dbq, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get backup dir file name of legacy backup file name
+func legacyBakName(n string) (string, bool) {
+	if name, ok := strings.CutSuffix(n, keyBakSuffix); ok {
+		return name, name != ""
+	}
+	i := strings.LastIndex(n, keyBakSuffix+keySep)
+	if i <= 0 {
+		return "", false
+	}
+	gen, err := strconv.Atoi(n[i+len(keyBakSuffix+keySep):])
+	if err != nil || gen <= 0 {
+		return "", false
+	}
+	return n[:i] + keySep + strconv.Itoa(gen), true
+}
@@ -0,0 +1,250 @@
+package filedb
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestBackupGenerations(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes int
+		gens   []int
+	}{
+		{"disabled", 0, 3, []int{}},
+		{"single write", 2, 1, []int{}},
+		{"below limit", 3, 3, []int{1, 2}},
+		{"at limit", 2, 3, []int{1, 2}},
+		{"beyond limit", 2, 6, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		dbc, _ := newMemCollection(t, Options{"backup_generations": tt.limit})
+		q := dbc.Query()
+		for i := 1; i <= tt.writes; i++ {
+			if err := q.Set("k", []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		gens, err := q.ListGenerations("k")
+		if err != nil || !slices.Equal(gens, tt.gens) {
+			t.Errorf("%s: expected generations %v, got %v %v",
+				tt.name, tt.gens, gens, err)
+			continue
+		}
+		// generation N holds the value written N writes ago
+		for _, gen := range gens {
+			value, err := q.GetGeneration("k", gen)
+			want := fmt.Sprint(tt.writes - gen)
+			if err != nil || string(value) != want {
+				t.Errorf("%s: generation %d expected %q, got %q %v",
+					tt.name, gen, want, value, err)
+			}
+		}
+	}
+}
+
+func TestRestoreGeneration(t *testing.T) {
+	dbc, _ := newMemCollection(
+		t, Options{"backup_generations": 3, "checksum": true})
+	q := dbc.Query()
+	for _, v := range []string{"a", "b", "c"} {
+		q.Set("k", []byte(v))
+	}
+	if err := q.RestoreGeneration("k", 2); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := q.Get("k"); err != nil || string(value) != "a" {
+		t.Errorf("expected restored value, got %q %v", value, err)
+	}
+	if value, err := q.GetGeneration("k", 1); err != nil || string(value) != "c" {
+		t.Errorf("expected replaced value in generation 1, got %q %v", value, err)
+	}
+	if err := q.RestoreGeneration("k", 9); err != ErrNotExist {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestGenerationGaps(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		gens  []int
+		want  []string
+	}{
+		{"gap after newest", 3, []int{1, 3}, []string{"cur", "g1", "g3"}},
+		{"missing newest", 3, []int{2, 5}, []string{"cur", "g2", "g5"}},
+		{"over limit", 2, []int{1, 2, 4}, []string{"cur", "g1"}},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(t, Options{"backup_generations": tt.limit})
+		q := dbc.Query()
+		q.Set("k", []byte("cur"))
+		for _, gen := range tt.gens {
+			st.WriteFile(fmt.Sprintf("/db/.bak/k.%d", gen),
+				[]byte(fmt.Sprintf("g%d", gen)), 0o664)
+		}
+		if err := q.Set("k", []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		gens, _ := q.ListGenerations("k")
+		values := []string{}
+		for _, gen := range gens {
+			value, _ := q.GetGeneration("k", gen)
+			values = append(values, string(value))
+		}
+		if !slices.Equal(gens, []int{1, 2, 3}[:len(tt.want)]) ||
+			!slices.Equal(values, tt.want) {
+			t.Errorf("%s: expected %v, got %v %v", tt.name, tt.want, gens, values)
+		}
+	}
+}
+
+func TestLegacyBackups(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy bool
+		value  string
+		keys   []string
+		badkey bool
+	}{
+		{"default layout", false, "", []string{"u_bak"}, false},
+		{"legacy mode", true, "old", []string{}, true},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(t, Options{"legacy_backups": tt.legacy})
+		st.MkdirAll("/db", 0o775)
+		st.WriteFile("/db/u_bak", []byte("old"), 0o664)
+		q := dbc.Query()
+
+		keys, _ := q.Keys()
+		if !slices.Equal(keys, tt.keys) {
+			t.Errorf("%s: expected keys %v, got %v", tt.name, tt.keys, keys)
+		}
+		value, _ := q.Get("u")
+		if string(value) != tt.value {
+			t.Errorf("%s: expected value %q, got %q", tt.name, tt.value, value)
+		}
+		err := q.Set("x_bak", []byte("x"))
+		if errors.Is(err, ErrKeyFormat) != tt.badkey {
+			t.Errorf("%s: unexpected key error %v", tt.name, err)
+		}
+		err = dbc.MigrateBackups()
+		if (err == nil) != tt.legacy {
+			t.Errorf("%s: unexpected migrate error %v", tt.name, err)
+		}
+	}
+}
+
+func TestLegacyBackupsPurged(t *testing.T) {
+	ops := []struct {
+		name string
+		op   func(q *Query) error
+	}{
+		{"set", func(q *Query) error { return q.Set("k", []byte("new")) }},
+		{"delete", func(q *Query) error { return q.Delete("k") }},
+		{"rename", func(q *Query) error { return q.RenameKey("k", "r", nil) }},
+	}
+	for _, o := range ops {
+		dbc, st := newMemCollection(t, Options{"legacy_backups": true})
+		st.MkdirAll("/db", 0o775)
+		st.WriteFile("/db/k", []byte("cur"), 0o664)
+		st.WriteFile("/db/k_bak", []byte("old"), 0o664)
+		if err := o.op(dbc.Query()); err != nil {
+			t.Fatalf("%s: %v", o.name, err)
+		}
+		checkFile(t, st, "/db/k_bak", nil)
+	}
+}
+
+func TestMigrateBackups(t *testing.T) {
+	dbc, st := newMemCollection(t, Options{"legacy_backups": true})
+	st.MkdirAll("/db/c", 0o775)
+	files := map[string]string{
+		"/db/k":         "m",
+		"/db/k_bak":     "b",
+		"/db/k_bak.1":   "g1",
+		"/db/c/x":       "xm",
+		"/db/c/x_bak":   "xb",
+		"/db/c/x_bak.2": "xg2",
+	}
+	for p, v := range files {
+		st.WriteFile(p, []byte(v), 0o664)
+	}
+	if err := dbc.MigrateBackups(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/db/.bak/k":     "b",
+		"/db/.bak/k.1":   "g1",
+		"/db/c/.bak/x":   "xb",
+		"/db/c/.bak/x.2": "xg2",
+	}
+	for p, v := range want {
+		checkFile(t, st, p, []byte(v))
+	}
+	for _, p := range []string{"/db/k_bak", "/db/k_bak.1", "/db/c/x_bak"} {
+		checkFile(t, st, p, nil)
+	}
+}
+
+func TestDeletePurgesBackups(t *testing.T) {
+	dbc, st := newMemCollection(t, Options{"backup_generations": 2})
+	q := dbc.Query()
+	for _, v := range []string{"1", "2", "3"} {
+		q.Set("k", []byte(v))
+	}
+
+	// delete waits for the key dir lock held by concurrent writes
+	err := q.WithDirLock("/db", func(*FileEngine) error {
+		dbq := dbc.Query()
+		dbq.OpTimeout, dbq.OpPolling = 0.2, 0.05
+		return dbq.Delete("k")
+	})
+	if err != ErrTimeout {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	checkFile(t, st, "/db/k", []byte("3"))
+
+	if err := q.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/db/k", "/db/.bak/k", "/db/.bak/k.1", "/db/.bak/k.2"} {
+		checkFile(t, st, p, nil)
+	}
+}
+
+func TestBackupPolicyOption(t *testing.T) {
+	tests := []struct {
+		policy string
+		ok     bool
+	}{
+		{"set", true},
+		{"verify", true},
+		{"none", true},
+		{"", false},
+		{"always", false},
+	}
+	for _, tt := range tests {
+		dbc, _ := newMemCollection(t, Options{"backup_generations": 1})
+		err := dbc.UpdateOptions(
+			Options{"backup_policy": tt.policy, "backup_generations": 2})
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: unexpected error %v", tt.policy, err)
+		}
+		want := BackupPolicy(tt.policy)
+		if !tt.ok {
+			// options are left unchanged on invalid values
+			want = BackupOnSet
+			if dbc.backupGenerations != 1 {
+				t.Errorf("%q: unexpected generations change", tt.policy)
+			}
+		}
+		if dbc.backupPolicy != want {
+			t.Errorf("%q: expected policy %q, got %q",
+				tt.policy, want, dbc.backupPolicy)
+		}
+	}
+}
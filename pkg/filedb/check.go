@@ -0,0 +1,369 @@
+package filedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// check issue types
+const (
+	// main file missing while a valid backup exists
+	CheckMissingMain = "missing_main"
+	// backup file missing for valid main file
+	CheckMissingBackup = "missing_backup"
+	// main and backup files are valid with different content
+	CheckMismatch = "mismatch"
+	// file failing to read or verify its record checksum
+	CheckCorrupt = "corrupt"
+	// value is not valid json
+	CheckInvalidJSON = "invalid_json"
+	// value failing to decrypt with collection cipher
+	CheckDecryptFailed = "decrypt_failed"
+	// backup or generation files without main file
+	CheckOrphanBackup = "orphan_backup"
+	// temp file left by interrupted write
+	CheckTempFile = "temp_file"
+	// dir without keys or child collections
+	CheckEmptyDir = "empty_dir"
+)
+
+// check options:
+//
+//	repair: bool  repair issues from the best valid copy, remove orphan
+//	              backups, temp files and empty dirs (default false)
+//	json:   bool  check values are valid json (default false)
+//	secure: bool  check values decrypt with collection cipher, the json
+//	              check applies to decrypted values (default false)
+
+// CheckIssue describes an integrity issue found by Check
+type CheckIssue struct {
+	// issue type
+	Type string `json:"type"`
+	// key relative to checked collection, empty for non key files
+	Key string `json:"key,omitempty"`
+	// path of file or dir with issue
+	Path string `json:"path"`
+	// error detail
+	Error string `json:"error,omitempty"`
+	// issue was repaired
+	Repaired bool `json:"repaired"`
+}
+
+// CheckReport is the result of collection integrity check
+type CheckReport struct {
+	// number of keys with valid values
+	Keys int `json:"keys"`
+	// found issues
+	Issues []CheckIssue `json:"issues"`
+}
+
+// check if no unrepaired issues were found
+func (r *CheckReport) OK() bool {
+	for _, i := range r.Issues {
+		if !i.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// check integrity of keys in collection and its child collections,
+// indexes are not checked. the collection is locked exclusively during
+// the check.
+func (dbc *Collection) Check(opts Options) (report *CheckReport, err error) {
+	defer dbc.logOp("check", time.Now(), &err)
+
+	if dbc.keyErr != nil {
+		return nil, dbc.keyErr
+	}
+	if opts.GetBool("secure", false) && dbc.cipher == nil {
+		return nil, ErrNoSecurity
+	}
+	report = &CheckReport{Issues: []CheckIssue{}}
+	if !dbc.IsExist() {
+		return report, nil
+	}
+
+	err = dbc.withTreeLock(dbc.Query().FileEngine, func(dbq *Query) error {
+		c := &checker{
+			dbq:    dbq,
+			repair: opts.GetBool("repair", false),
+			json:   opts.GetBool("json", false),
+			secure: opts.GetBool("secure", false),
+			report: report,
+		}
+		return c.checkDir(dbc.base_path, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+type checker struct {
+	dbq    *Query
+	repair bool
+	json   bool
+	secure bool
+	report *CheckReport
+}
+
+// check keys of dir then its sub dirs
+func (c *checker) checkDir(dirpath string, prefix []string) error {
+	dbc := c.dbq.collection
+	if dbc.ctx.Err() != nil {
+		return ctxError(dbc.ctx)
+	}
+
+	entries, err := dbc.storage.ReadDir(dirpath)
+	if err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+	names, dirs, legacy := map[string]bool{}, []string{}, []string{}
+	empty := true
+	for _, e := range entries {
+		n := e.Name()
+		switch {
+		case e.IsDir() && n == bakDir:
+			if err := c.scanBackups(dirpath, names); err != nil {
+				return err
+			}
+		case e.IsDir():
+			if _, ok := dbc.nameKey(n); ok {
+				dirs = append(dirs, n)
+			}
+			empty = false
+		case isTempFile(n):
+			c.tempFile(filepath.Join(dirpath, n))
+		case dbc.isLegacyBak(n):
+			legacy = append(legacy, n)
+			empty = false
+		case n != collectionLockFile:
+			if _, ok := dbc.nameKey(n); ok && e.Type().IsRegular() {
+				names[n] = true
+			}
+			empty = false
+		}
+	}
+
+	keys := make([]string, 0, len(names))
+	for n := range names {
+		keys = append(keys, n)
+	}
+	slices.Sort(keys)
+	for _, n := range keys {
+		c.checkKey(dirpath, prefix, n)
+	}
+	c.checkLegacyBackups(dirpath, legacy, names)
+
+	for _, d := range dirs {
+		key, _ := dbc.nameKey(d)
+		sub := append(append([]string{}, prefix...), key)
+		if err := c.checkDir(filepath.Join(dirpath, d), sub); err != nil {
+			return err
+		}
+	}
+
+	if empty && len(names) == 0 && prefix != nil {
+		c.emptyDir(dirpath)
+	}
+	return nil
+}
+
+// collect key names of backup files and check temp and orphan
+// generation files
+func (c *checker) scanBackups(dirpath string, names map[string]bool) error {
+	dbc := c.dbq.collection
+	bakpath := filepath.Join(dirpath, bakDir)
+	entries, err := dbc.storage.ReadDir(bakpath)
+	if err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+	gens := []string{}
+	for _, e := range entries {
+		n := e.Name()
+		if isTempFile(n) {
+			c.tempFile(filepath.Join(bakpath, n))
+			continue
+		}
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if strings.Contains(n, keySep) {
+			gens = append(gens, n)
+		} else if _, ok := dbc.nameKey(n); ok {
+			names[n] = true
+		}
+	}
+
+	// generations are orphans if neither main nor backup file exists
+	for _, n := range gens {
+		name, _, _ := strings.Cut(n, keySep)
+		if names[name] || c.dbq.FileExist(filepath.Join(dirpath, name)) {
+			continue
+		}
+		path := filepath.Join(bakpath, n)
+		c.issue(CheckOrphanBackup, "", path, nil,
+			func() error { return dbc.storage.Remove(path) })
+	}
+	return nil
+}
+
+// check legacy backup files of dir are not orphans, legacy backups are
+// orphans if neither main nor backup file of their key exists
+func (c *checker) checkLegacyBackups(
+	dirpath string, legacy []string, names map[string]bool) {
+	for _, n := range legacy {
+		name, _ := legacyBakName(n)
+		name, _, _ = strings.Cut(name, keySep)
+		if names[name] {
+			continue
+		}
+		path := filepath.Join(dirpath, n)
+		c.issue(CheckOrphanBackup, "", path, nil,
+			func() error { return c.dbq.collection.storage.Remove(path) })
+	}
+}
+
+// check key main and backup files, repairs use the best valid copy
+func (c *checker) checkKey(dirpath string, prefix []string, name string) {
+	dbc := c.dbq.collection
+	key, _ := dbc.nameKey(name)
+	key = strings.Join(append(append([]string{}, prefix...), key), keySep)
+	mainpath := filepath.Join(dirpath, name)
+	bakpath := filepath.Join(dirpath, bakDir, name)
+
+	mainraw, mainErr := c.readValid(mainpath)
+	bakraw, bakErr := c.readValid(bakpath)
+
+	writeBak := func() error { return c.dbq.WriteFile(bakpath, mainraw) }
+	writeMain := func() error { return c.dbq.WriteFile(mainpath, bakraw) }
+
+	switch {
+	case mainErr == nil:
+		c.report.Keys++
+		if dbc.backupPolicy == BackupDisabled {
+			return
+		}
+		switch {
+		case errors.Is(bakErr, ErrNotExist):
+			c.issue(CheckMissingBackup, key, bakpath, nil, writeBak)
+		case bakErr != nil:
+			c.issue(checkErrType(bakErr), key, bakpath, bakErr, writeBak)
+		case !bytes.Equal(mainraw, bakraw):
+			c.issue(CheckMismatch, key, bakpath, nil, writeBak)
+		}
+
+	case errors.Is(mainErr, ErrNotExist):
+		if bakErr == nil {
+			c.report.Keys++
+			c.issue(CheckMissingMain, key, mainpath, nil, writeMain)
+		} else if !errors.Is(bakErr, ErrNotExist) {
+			c.issue(CheckOrphanBackup, key, bakpath, bakErr,
+				func() error { return dbc.storage.Remove(bakpath) })
+		}
+
+	default:
+		if bakErr == nil {
+			c.report.Keys++
+			c.issue(checkErrType(mainErr), key, mainpath, mainErr, writeMain)
+			return
+		}
+		c.issue(checkErrType(mainErr), key, mainpath, mainErr, nil)
+		if !errors.Is(bakErr, ErrNotExist) {
+			c.issue(checkErrType(bakErr), key, bakpath, bakErr, nil)
+		}
+	}
+}
+
+// read file and validate its value, returns the raw file content
+func (c *checker) readValid(path string) ([]byte, error) {
+	if !c.dbq.FileExist(path) {
+		return nil, ErrNotExist
+	}
+	rawdata, err := c.dbq.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w - %w", ErrCorrupt, err)
+	}
+	value, _, err := c.dbq.collection.decodeValue(rawdata)
+	if err != nil {
+		return nil, err
+	}
+	if c.secure {
+		value, err = c.dbq.collection.cipher.Decrypt(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w - %s", ErrDecrypt, err.Error())
+		}
+	}
+	if c.json && !json.Valid(value) {
+		return nil, errCheckJSON
+	}
+	return rawdata, nil
+}
+
+var errCheckJSON = errors.New("invalid json value")
+
+// get issue type of validation error
+func checkErrType(err error) string {
+	switch {
+	case errors.Is(err, ErrDecrypt):
+		return CheckDecryptFailed
+	case errors.Is(err, errCheckJSON):
+		return CheckInvalidJSON
+	}
+	return CheckCorrupt
+}
+
+func (c *checker) tempFile(path string) {
+	c.issue(CheckTempFile, "", path, nil,
+		func() error { return c.dbq.collection.storage.Remove(path) })
+}
+
+func (c *checker) emptyDir(dirpath string) {
+	st := c.dbq.collection.storage
+	c.issue(CheckEmptyDir, "", dirpath, nil, func() error {
+		// empty backup dir and lock file are removed first, removing
+		// non empty dirs fails
+		for _, n := range []string{bakDir, collectionLockFile} {
+			if _, err := st.Stat(filepath.Join(dirpath, n)); err == nil {
+				st.Remove(filepath.Join(dirpath, n))
+			}
+		}
+		return st.Remove(dirpath)
+	})
+}
+
+// add issue to report, repairing it in repair mode if repairable
+func (c *checker) issue(
+	typ, key, path string, err error, repair func() error) {
+	i := CheckIssue{Type: typ, Key: key, Path: path}
+	if err != nil {
+		i.Error = err.Error()
+	}
+	if c.repair && repair != nil {
+		if rerr := repair(); rerr != nil {
+			if i.Error != "" {
+				i.Error += " - "
+			}
+			i.Error += "repair failed: " + rerr.Error()
+		} else {
+			i.Repaired = true
+		}
+	}
+	c.report.Issues = append(c.report.Issues, i)
+
+	logRecord(c.dbq.ctx, c.dbq.logger, slog.LevelWarn, "filedb check issue",
+		slog.String("op", "check"),
+		slog.String("type", typ),
+		slog.String("key", key),
+		slog.String("path", path),
+		slog.String("error", i.Error),
+		slog.Bool("repaired", i.Repaired))
+}
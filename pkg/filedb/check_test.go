@@ -0,0 +1,104 @@
+package filedb
+
+import (
+	"slices"
+	"testing"
+)
+
+// fill collection with keys having integrity issues
+func fillCheckCollection(t *testing.T) (*Collection, *MemStorage) {
+	t.Helper()
+	dbc, st := newMemCollection(
+		t, Options{"checksum": true, "backup_generations": 1})
+	q := dbc.Query()
+	for _, k := range []string{"ok", "nomain", "nobak", "mismatch", "corrupt",
+		"bad", "c.k", "json"} {
+		q.Set(k, []byte(`{"k":"`+k+`"}`))
+	}
+	q.Set("json", []byte("not json"))
+	q.Set("orphan", []byte("v"))
+	q.Set("orphan", []byte("v2"))
+
+	st.Remove("/db/nomain")
+	st.Remove("/db/.bak/nobak")
+	st.WriteFile("/db/.bak/mismatch", encodeRecord([]byte(`{}`), 0), 0o664)
+	st.WriteFile("/db/corrupt", []byte("FDBR corrupted"), 0o664)
+	st.WriteFile("/db/bad", []byte("FDBR corrupted"), 0o664)
+	st.WriteFile("/db/.bak/bad", []byte("FDBR corrupted"), 0o664)
+	st.Remove("/db/orphan")
+	st.Remove("/db/.bak/orphan")
+	st.WriteFile("/db/.k.1234.tmp", []byte("v"), 0o664)
+	st.MkdirAll("/db/empty", 0o775)
+	return dbc, st
+}
+
+func TestCheck(t *testing.T) {
+	dbc, _ := fillCheckCollection(t)
+	report, err := dbc.Check(Options{"json": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		CheckCorrupt + " bad /db/bad",
+		CheckCorrupt + " bad /db/.bak/bad",
+		CheckCorrupt + " corrupt /db/corrupt",
+		CheckInvalidJSON + " json /db/json",
+		CheckInvalidJSON + " json /db/.bak/json",
+		CheckMismatch + " mismatch /db/.bak/mismatch",
+		CheckMissingBackup + " nobak /db/.bak/nobak",
+		CheckMissingMain + " nomain /db/nomain",
+		CheckOrphanBackup + "  /db/.bak/orphan.1",
+		CheckTempFile + "  /db/.k.1234.tmp",
+		CheckEmptyDir + "  /db/empty",
+	}
+	got := []string{}
+	for _, i := range report.Issues {
+		if i.Repaired {
+			t.Errorf("unexpected repaired issue %v", i)
+		}
+		got = append(got, i.Type+" "+i.Key+" "+i.Path)
+	}
+	slices.Sort(want)
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("expected issues:\n%v\ngot:\n%v", want, got)
+	}
+	// ok, nomain, nobak, mismatch, corrupt and c.k have a valid copy
+	if report.Keys != 6 || report.OK() {
+		t.Errorf("unexpected report keys %d ok %v", report.Keys, report.OK())
+	}
+}
+
+func TestCheckRepair(t *testing.T) {
+	dbc, st := fillCheckCollection(t)
+	report, err := dbc.Check(Options{"repair": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range report.Issues {
+		// keys without valid copy can't be repaired
+		if i.Repaired == (i.Key == "bad") {
+			t.Errorf("unexpected repair state %v", i)
+		}
+	}
+
+	report, err = dbc.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 2 || report.Issues[0].Key != "bad" {
+		t.Errorf("expected only unrepairable issues, got %v", report.Issues)
+	}
+	q := dbc.Query()
+	for _, k := range []string{"nomain", "nobak", "corrupt"} {
+		if value, err := q.Get(k); err != nil || string(value) != `{"k":"`+k+`"}` {
+			t.Errorf("%s: expected repaired value, got %q %v", k, value, err)
+		}
+	}
+	for _, p := range []string{"/db/.bak/orphan.1", "/db/.k.1234.tmp"} {
+		checkFile(t, st, p, nil)
+	}
+	if _, err := st.Stat("/db/empty"); err == nil {
+		t.Error("expected empty dir removed")
+	}
+}
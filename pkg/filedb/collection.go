@@ -1,23 +1,73 @@
 package filedb
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/exonlabs/go-utils/pkg/crypto/xcipher"
-	"github.com/exonlabs/go-utils/pkg/os/xcopy"
 )
 
 type Collection struct {
 	// base path prefix for all operations
 	base_path string
 
+	// path of root collection, collections are locked from the root
+	// down to the collection by all operations
+	root_path string
+
+	// storage backend
+	storage Storage
+
+	// operation context
+	ctx context.Context
+
+	// invalid key error of child or index collections created with
+	// invalid keys, returned by all operations
+	keyErr error
+
 	// cipher object
 	cipher xcipher.Cipher
+
+	// write values with checksummed record header
+	checksum bool
+
+	// read headerless values written before checksum option was enabled
+	legacyValues bool
+
+	// log key writes in journal for crash recovery
+	journal bool
+
+	// backup files policy
+	backupPolicy BackupPolicy
+
+	// number of previous values kept as backup generations
+	backupGenerations int
+
+	// store keys as single encoded names allowing arbitrary strings
+	keyEncoding bool
+
+	// use and purge backups of the legacy key_bak layout
+	legacyBackups bool
+
+	// key of collection relative to root collection with trailing key
+	// separator, empty for root collection
+	keyPrefix string
+
+	// change hooks registry shared with all collections of the root
+	hooks *hooks
+
+	// metrics collector shared with child collections
+	metrics *Metrics
+
+	// structured logger shared with child collections
+	logger *slog.Logger
 }
 
 func NewCollection(path string) (*Collection, error) {
@@ -25,11 +75,26 @@ func NewCollection(path string) (*Collection, error) {
 	if path == string(filepath.Separator) || path == filepath.Dir(path) {
 		return nil, errors.New("invalid collection path")
 	}
+	path = strings.TrimSuffix(path, fileSep)
 	return &Collection{
-		base_path: strings.TrimSuffix(path, fileSep),
+		base_path:    path,
+		root_path:    path,
+		storage:      defaultStorage,
+		ctx:          context.Background(),
+		backupPolicy: BackupOnSet,
+		hooks:        &hooks{},
 	}, nil
 }
 
+// create copy of collection bound to context, scans and copies are
+// aborted when context is done. queries created from the returned
+// collection inherit the context.
+func (dbc *Collection) WithContext(ctx context.Context) *Collection {
+	c := *dbc
+	c.ctx = ctx
+	return &c
+}
+
 func (dbc *Collection) String() string {
 	return fmt.Sprintf("<Collection: %s>", dbc.base_path)
 }
@@ -52,17 +117,70 @@ func (dbc *Collection) InitAES256(secret string) error {
 	return nil
 }
 
-// convert relative file or collection key to absolute path
+// update collection options, options are left unchanged if any
+// option value is invalid
+func (dbc *Collection) UpdateOptions(opts Options) error {
+	policy := BackupPolicy(opts.GetString(
+		"backup_policy", string(dbc.backupPolicy)))
+	switch policy {
+	case BackupOnSet, BackupVerify, BackupDisabled:
+	default:
+		return fmt.Errorf("%winvalid backup policy: %s", ErrError, policy)
+	}
+
+	dbc.checksum = opts.GetBool("checksum", dbc.checksum)
+	dbc.legacyValues = opts.GetBool("legacy_values", dbc.legacyValues)
+	dbc.journal = opts.GetBool("journal", dbc.journal)
+	dbc.backupPolicy = policy
+	dbc.backupGenerations = opts.GetInt(
+		"backup_generations", dbc.backupGenerations)
+	dbc.keyEncoding = opts.GetBool("key_encoding", dbc.keyEncoding)
+	dbc.legacyBackups = opts.GetBool("legacy_backups", dbc.legacyBackups)
+	return nil
+}
+
+// set storage backend for collection, default is the filesystem storage
+func (dbc *Collection) InitStorage(st Storage) {
+	dbc.storage = st
+}
+
+// convert relative file or collection key to absolute path, the key is
+// not validated so KeyPathErr should be used for untrusted keys
 func (dbc *Collection) KeyPath(key string) string {
+	return dbc.keyPath(key)
+}
+
+// convert relative file or collection key to absolute path validating
+// the key, the empty key is the collection path
+func (dbc *Collection) KeyPathErr(key string) (string, error) {
+	if dbc.keyErr != nil {
+		return "", dbc.keyErr
+	}
+	if key != "" {
+		if err := dbc.checkKey(key); err != nil {
+			return "", err
+		}
+	}
+	return dbc.keyPath(key), nil
+}
+
+// convert validated key to absolute path
+func (dbc *Collection) keyPath(key string) string {
 	if key == "" {
 		return dbc.base_path
 	}
+	if dbc.keyEncoding {
+		return dbc.base_path + fileSep + encodeKey(key)
+	}
 	k := strings.ReplaceAll(key, keySep, fileSep)
 	return dbc.base_path + fileSep + k
 }
 
 func (dbc *Collection) IsExist() bool {
-	finfo, err := os.Stat(dbc.base_path)
+	if dbc.keyErr != nil {
+		return false
+	}
+	finfo, err := dbc.storage.Stat(dbc.base_path)
 	if os.IsNotExist(err) {
 		return false
 	}
@@ -72,107 +190,285 @@ func (dbc *Collection) IsExist() bool {
 	return true
 }
 
-func (dbc *Collection) Copy(srckey, dstkey string) error {
-	if srckey == "" {
-		return fmt.Errorf("%wsource key is not defined", ErrError)
+// copy child collection into dstkey keeping its base name
+func (dbc *Collection) Copy(srckey, dstkey string) (err error) {
+	defer dbc.logOp("copy", time.Now(), &err,
+		slog.String("src", srckey), slog.String("dst", dstkey))
+
+	if err := dbc.checkCopyKeys(srckey, dstkey); err != nil {
+		return err
 	}
-	srckeypath := dbc.KeyPath(srckey)
-	srcinfo, err := os.Stat(srckeypath)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("%wsrc collection does not exist", ErrError)
-	} else if srcinfo != nil && !srcinfo.Mode().IsDir() {
-		return fmt.Errorf("%wsrc key is not collection", ErrError)
+	dbq := dbc.Query()
+	release, err := dbc.lockStructure(dbq.FileEngine)
+	if err != nil {
+		return err
 	}
+	defer release()
 
-	srckeyParts := strings.Split(srckey, keySep)
-	srckeyBase := srckeyParts[len(srckeyParts)-1]
+	srcpath, dstpath := dbc.keyPath(srckey), dbc.dstPath(srckey, dstkey)
+	if err := dbc.checkCopy(srcpath, dstpath); err != nil {
+		return err
+	}
 
-	dstkeypath := dbc.KeyPath(dstkey + keySep + srckeyBase)
-	_, err = os.Stat(dstkeypath)
-	if !os.IsNotExist(err) {
-		return fmt.Errorf("%wdst collection already exists", ErrError)
+	// log copy intent, unfinished copies are undone by Recover
+	jpath := dbc.newJournalPath(journalCopy)
+	entry := &journalEntry{
+		Type: journalCopy, Src: dbc.relPath(srcpath), Dst: dbc.relPath(dstpath)}
+	if err := dbc.writeJournal(dbq, jpath, entry); err != nil {
+		return err
 	}
 
-	if err := xcopy.CopyDir(srckeypath, dstkeypath); err != nil {
+	if err := dbc.copyTree(srcpath, dstpath); err != nil {
+		dbc.storage.RemoveAll(dstpath)
+		dbq.PurgeFile(jpath)
+		if errors.Is(err, ErrError) {
+			return err
+		}
 		return fmt.Errorf("%w%s", ErrError, err.Error())
 	}
-	return nil
+	return dbq.PurgeFile(jpath)
 }
 
-func (dbc *Collection) Purge(key string) error {
+func (dbc *Collection) Purge(key string) (err error) {
+	defer dbc.logOp("purge", time.Now(), &err, slog.String("key", key))
+
 	if key == "" {
 		return fmt.Errorf("%wkey is not defined", ErrError)
 	}
-	keypath := dbc.KeyPath(key)
-	finfo, err := os.Stat(keypath)
+	if err := dbc.checkKey(key); err != nil {
+		return err
+	}
+	keypath := dbc.keyPath(key)
+	finfo, err := dbc.storage.Stat(keypath)
 	if os.IsNotExist(err) {
 		return nil
 	} else if finfo != nil && !finfo.Mode().IsDir() {
 		return fmt.Errorf("%wkey is not collection", ErrError)
 	}
-	return os.RemoveAll(keypath)
+
+	release, err := dbc.lockStructure(dbc.Query().FileEngine)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if dbc.ctx.Err() != nil {
+		return ctxError(dbc.ctx)
+	}
+	return dbc.storage.RemoveAll(keypath)
 }
 
-func (dbc *Collection) Move(srckey, dstkey string) error {
-	if err := dbc.Copy(srckey, dstkey); err != nil {
+// move child collection into dstkey keeping its base name
+func (dbc *Collection) Move(srckey, dstkey string) (err error) {
+	defer dbc.logOp("move", time.Now(), &err,
+		slog.String("src", srckey), slog.String("dst", dstkey))
+
+	if err := dbc.checkCopyKeys(srckey, dstkey); err != nil {
 		return err
 	}
-	return dbc.Purge(srckey)
+	return dbc.rename(srckey, dbc.dstPath(srckey, dstkey))
+}
+
+// move child collection to newkey, the collection is renamed in place
+// when possible, else it is copied then purged using the journal
+func (dbc *Collection) Rename(srckey, newkey string) (err error) {
+	defer dbc.logOp("rename", time.Now(), &err,
+		slog.String("src", srckey), slog.String("dst", newkey))
+
+	if err := dbc.checkCopyKeys(srckey, newkey); err != nil {
+		return err
+	}
+	if newkey == "" {
+		return fmt.Errorf("%winvalid dst collection key", ErrError)
+	}
+	return dbc.rename(srckey, dbc.keyPath(newkey))
+}
+
+// move child collection to destination path
+func (dbc *Collection) rename(srckey, dstpath string) error {
+	dbq := dbc.Query()
+	release, err := dbc.lockStructure(dbq.FileEngine)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	srcpath := dbc.keyPath(srckey)
+	if err := dbc.checkCopy(srcpath, dstpath); err != nil {
+		return err
+	}
+
+	// try atomic rename first
+	if err := dbc.storage.MkdirAll(filepath.Dir(dstpath),
+		os.FileMode(dbq.DirPerm)); err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+	err = dbc.storage.Rename(srcpath, dstpath)
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+
+	// log move intent for cross device moves, Recover undoes unfinished
+	// copy phase and completes unfinished purge phase
+	jpath := dbc.newJournalPath(journalMove)
+	entry := &journalEntry{
+		Type: journalMove, Src: dbc.relPath(srcpath), Dst: dbc.relPath(dstpath)}
+	if err := dbc.writeJournal(dbq, jpath, entry); err != nil {
+		return err
+	}
+
+	if err := dbc.copyTree(srcpath, dstpath); err != nil {
+		dbc.storage.RemoveAll(dstpath)
+		dbq.PurgeFile(jpath)
+		if errors.Is(err, ErrError) {
+			return err
+		}
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+
+	entry.Phase = journalPhasePurge
+	if err := dbc.writeJournal(dbq, jpath, entry); err != nil {
+		return err
+	}
+	if err := dbc.storage.RemoveAll(srcpath); err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+	return dbq.PurgeFile(jpath)
+}
+
+// check source and full destination paths of collection copy
+func (dbc *Collection) checkCopy(srcpath, dstpath string) error {
+	srcinfo, err := dbc.storage.Stat(srcpath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%wsrc collection does not exist", ErrError)
+	} else if srcinfo != nil && !srcinfo.Mode().IsDir() {
+		return fmt.Errorf("%wsrc key is not collection", ErrError)
+	}
+
+	if dstpath == dbc.base_path || dstpath == srcpath ||
+		strings.HasPrefix(dstpath, srcpath+fileSep) {
+		return fmt.Errorf("%winvalid dst collection key", ErrError)
+	}
+	_, err = dbc.storage.Stat(dstpath)
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("%wdst collection already exists", ErrError)
+	}
+	return nil
+}
+
+// validate source and destination keys of collection copy, empty
+// destination key refers to the collection itself
+func (dbc *Collection) checkCopyKeys(srckey, dstkey string) error {
+	if srckey == "" {
+		return fmt.Errorf("%wsource key is not defined", ErrError)
+	}
+	if err := dbc.checkKey(srckey); err != nil {
+		return err
+	}
+	if dstkey == "" {
+		return dbc.keyErr
+	}
+	return dbc.checkKey(dstkey)
+}
+
+// get full destination path in dstkey keeping the source base name
+func (dbc *Collection) dstPath(srckey, dstkey string) string {
+	return filepath.Join(
+		dbc.keyPath(dstkey), filepath.Base(dbc.keyPath(srckey)))
+}
+
+// copy dir tree preserving permissions, checking context between entries
+func (dbc *Collection) copyTree(src, dst string) error {
+	if dbc.ctx.Err() != nil {
+		return ctxError(dbc.ctx)
+	}
+	info, err := dbc.storage.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := dbc.storage.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return dbc.storage.WriteFile(dst, data, info.Mode().Perm())
+	}
+
+	if err := dbc.storage.MkdirAll(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	entries, err := dbc.storage.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := dbc.copyTree(
+			filepath.Join(src, e.Name()),
+			filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //////////////////////////////// child methods
 
 // create child collection relative to parent collection
 func (dbc *Collection) Child(key string) *Collection {
-	return &Collection{
-		base_path: dbc.KeyPath(key),
-		cipher:    dbc.cipher,
+	if err := dbc.checkKey(key); err != nil {
+		c := dbc.sub(dbc.base_path)
+		c.keyErr = err
+		return c
 	}
+	c := dbc.sub(dbc.keyPath(key))
+	c.keyPrefix = dbc.keyPrefix + key + keySep
+	return c
+}
+
+// create collection at path sharing parent settings
+func (dbc *Collection) sub(path string) *Collection {
+	c := *dbc
+	c.base_path = path
+	return &c
 }
 
 func (dbc *Collection) ListChilds() ([]string, error) {
-	res := []string{}
-	err := filepath.Walk(dbc.base_path,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() && path != dbc.base_path {
-				n := filepath.Base(path)
-				if !strings.HasPrefix(n, ".") {
-					res = append(res, n)
-				}
-				return fs.SkipDir
-			}
-			return nil
-		},
-	)
-	if err != nil {
-		return nil, err
-	}
-	return res, nil
+	return dbc.listDirs(dbc.nameKey)
 }
 
 func (dbc *Collection) ListIndexes() ([]string, error) {
-	res := []string{}
-	err := filepath.Walk(dbc.base_path,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() && path != dbc.base_path {
-				n := filepath.Base(path)
-				if strings.HasPrefix(n, ".ix_") {
-					res = append(res, strings.TrimPrefix(n, ".ix_"))
-				}
-				return fs.SkipDir
-			}
-			return nil
-		},
-	)
+	return dbc.listDirs(func(n string) (string, bool) {
+		return strings.TrimPrefix(n, ".ix_"), strings.HasPrefix(n, ".ix_")
+	})
+}
+
+// list sub dirs names of collection accepted by filter
+func (dbc *Collection) listDirs(
+	filter func(string) (string, bool)) ([]string, error) {
+	if dbc.keyErr != nil {
+		return nil, dbc.keyErr
+	}
+	if dbc.ctx.Err() != nil {
+		return nil, ctxError(dbc.ctx)
+	}
+	entries, err := dbc.storage.ReadDir(dbc.base_path)
 	if err != nil {
 		return nil, err
 	}
+	res := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if n, ok := filter(e.Name()); ok {
+			res = append(res, n)
+		}
+	}
 	return res, nil
 }
 
@@ -199,8 +495,15 @@ func (dbc *Collection) Index(key string) *Index {
 	parts[0] = ".ix_" + parts[0]
 
 	path := filepath.Join(dbc.base_path, filepath.Join(parts...))
-	col, _ := NewCollection(path)
+	col := dbc.sub(path)
+	// index names are plain keys, index values follow collection encoding
+	if err := dbc.checkIndexKey(key); err != nil {
+		col.base_path = dbc.base_path
+		col.keyErr = err
+	}
 	return &Index{
 		collection: col,
+		name:       key,
+		parent:     dbc,
 	}
 }
@@ -0,0 +1,99 @@
+package filedb
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+// storage failing renames across devices
+type crossDeviceStorage struct {
+	*MemStorage
+}
+
+func (st crossDeviceStorage) Rename(oldpath, newpath string) error {
+	return &os.LinkError{
+		Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+}
+
+func TestRenameCollection(t *testing.T) {
+	tests := []struct {
+		name  string
+		move  bool
+		src   string
+		dst   string
+		err   bool
+		path  string
+		cross bool
+	}{
+		{"rename", false, "a", "b", false, "/db/b/k", false},
+		{"rename nested", false, "a", "x.y", false, "/db/x/y/k", false},
+		{"move", true, "a", "d", false, "/db/d/a/k", false},
+		{"cross device rename", false, "a", "b", false, "/db/b/k", true},
+		{"cross device move", true, "a", "d", false, "/db/d/a/k", true},
+		{"existing dst", false, "a", "c", true, "", false},
+		{"into itself", false, "a", "a.x", true, "", false},
+		{"missing src", false, "m", "n", true, "", false},
+		{"empty dst", false, "a", "", true, "", false},
+		{"key src", false, "a.k", "n", true, "", false},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(t, nil)
+		q := dbc.Query()
+		q.Set("a.k", []byte("v"))
+		q.Set("c.k", []byte("c"))
+		if tt.cross {
+			dbc.InitStorage(crossDeviceStorage{st})
+		}
+
+		var err error
+		if tt.move {
+			err = dbc.Move(tt.src, tt.dst)
+		} else {
+			err = dbc.Rename(tt.src, tt.dst)
+		}
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if tt.err {
+			checkFile(t, st, "/db/a/k", []byte("v"))
+			continue
+		}
+		checkFile(t, st, "/db/a/k", nil)
+		checkFile(t, st, tt.path, []byte("v"))
+		if entries, _ := st.ReadDir(dbc.journalPath("")); len(entries) != 0 {
+			t.Errorf("%s: unexpected journal entries %d", tt.name, len(entries))
+		}
+	}
+}
+
+func TestRecoverCollectionMove(t *testing.T) {
+	tests := []struct {
+		name  string
+		phase string
+		src   []byte
+		dst   []byte
+	}{
+		{"copy phase", "", []byte("v"), nil},
+		{"purge phase", journalPhasePurge, nil, []byte("v")},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(t, nil)
+		q := dbc.Query()
+		q.Set("a.k", []byte("v"))
+		q.Set("b.k", []byte("v"))
+
+		// journal of cross device move interrupted in phase
+		entry := &journalEntry{Type: journalMove, Src: "a", Dst: "b", Phase: tt.phase}
+		st.MkdirAll(dbc.journalPath(""), 0o775)
+		if err := dbc.writeJournal(q, dbc.newJournalPath(journalMove), entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := dbc.Recover(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		checkFile(t, st, "/db/a/k", tt.src)
+		checkFile(t, st, "/db/b/k", tt.dst)
+	}
+}
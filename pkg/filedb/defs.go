@@ -11,9 +11,25 @@ import (
 type Options = types.NDict
 type Buffer = types.NDict
 
+// BackupPolicy defines how key backup files are maintained
+type BackupPolicy string
+
+const (
+	// write backup on Set only, main file is repaired from backup on read
+	// only when it is missing or corrupted
+	BackupOnSet BackupPolicy = "set"
+	// same as BackupOnSet, also the backup is compared on read and
+	// repaired when it is missing or differs from main file
+	BackupVerify BackupPolicy = "verify"
+	// no backup files are written
+	BackupDisabled BackupPolicy = "none"
+)
+
 const (
 	keySep           = "."
 	keyBakSuffix     = "_bak"
+	bakDir           = ".bak"
+	fileTmpSuffix    = ".tmp"
 	fileSep          = string(filepath.Separator)
 	defaultOpTimeout = float64(3)
 	defaultOpPolling = float64(0.1)
@@ -33,4 +49,8 @@ var (
 	ErrInvalidKey = fmt.Errorf("%winvalid key size", ErrError)
 	ErrEncrypt    = fmt.Errorf("%wencryption failed", ErrError)
 	ErrDecrypt    = fmt.Errorf("%wdecryption failed", ErrError)
+	ErrCorrupt    = fmt.Errorf("%wdata corrupted", ErrError)
+	ErrConflict   = fmt.Errorf("%wversion conflict", ErrError)
+	ErrExist      = fmt.Errorf("%wkey already exists", ErrError)
+	ErrKeyFormat  = fmt.Errorf("%winvalid key format", ErrError)
 )
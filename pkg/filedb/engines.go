@@ -1,18 +1,30 @@
 package filedb
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/exonlabs/go-utils/pkg/sync/xevent"
-	"golang.org/x/sys/unix"
 )
 
 type FileEngine struct {
+	// storage backend
+	storage Storage
+	// operation context
+	ctx context.Context
 	// operation events
 	evtBreak *xevent.Event
+	// dirs and collections locked by the current operation
+	locked map[string]bool
+	// metrics collector
+	metrics *Metrics
+	// structured logger
+	logger *slog.Logger
 
 	// timeout for operations like read/write
 	OpTimeout float64
@@ -24,9 +36,16 @@ type FileEngine struct {
 	FilePerm uint32
 }
 
-// create new file engine
+// create new file engine using the filesystem storage
 func NewFileEngine() *FileEngine {
+	return NewFileEngineWithStorage(defaultStorage)
+}
+
+// create new file engine using storage backend
+func NewFileEngineWithStorage(st Storage) *FileEngine {
 	return &FileEngine{
+		storage:   st,
+		ctx:       context.Background(),
 		evtBreak:  xevent.NewEvent(),
 		OpTimeout: defaultOpTimeout,
 		OpPolling: defaultOpPolling,
@@ -43,9 +62,17 @@ func (dbe *FileEngine) UpdateOptions(opts Options) {
 	dbe.FilePerm = opts.GetUint32("file_perm", dbe.FilePerm)
 }
 
+// create copy of file engine bound to context, blocking operations
+// are aborted when context is done
+func (dbe *FileEngine) WithContext(ctx context.Context) *FileEngine {
+	e := *dbe
+	e.ctx = ctx
+	return &e
+}
+
 // check if file exists and is regular file
 func (dbe *FileEngine) FileExist(fpath string) bool {
-	finfo, err := os.Stat(fpath)
+	finfo, err := dbe.storage.Stat(fpath)
 	if os.IsNotExist(err) {
 		return false
 	}
@@ -55,61 +82,89 @@ func (dbe *FileEngine) FileExist(fpath string) bool {
 	return true
 }
 
-// read file content with shared locking
+// read file content
+//
+// files are always replaced atomically by WriteFile, so readers see either
+// the old or the new content and no locking is needed for reading.
 func (dbe *FileEngine) ReadFile(fpath string) ([]byte, error) {
-	// open file for read
-	f, err := os.OpenFile(fpath, os.O_RDONLY, os.ModePerm)
-	if err != nil {
-		return nil, fmt.Errorf("%w - %s", ErrRead, err.Error())
-	}
-	defer f.Close()
-
-	// aquire file lock with retries
-	if err := dbe.aquireFilelock(
-		f, false, dbe.OpTimeout, dbe.OpPolling); err != nil {
-		return nil, err
+	if dbe.ctx.Err() != nil {
+		return nil, ctxError(dbe.ctx)
 	}
-	defer dbe.releaseFilelock(f)
-
-	finfo, _ := f.Stat()
-	data := make([]byte, finfo.Size())
-	_, err = f.Read(data)
+	data, err := dbe.storage.ReadFile(fpath)
 	if err != nil {
 		return nil, fmt.Errorf("%w - %s", ErrRead, err.Error())
 	}
 	return data, nil
 }
 
-// write content to file with exclusive locking
+// write content to file atomically with exclusive locking
+//
+// the target file is replaced on every write, so writers are serialized
+// by locking the parent dir instead of the file itself.
 func (dbe *FileEngine) WriteFile(fpath string, data []byte) error {
+	if dbe.ctx.Err() != nil {
+		return ctxError(dbe.ctx)
+	}
+
 	// create dir tree for file if not exist
-	if !dbe.FileExist(fpath) {
-		dirpath := filepath.Dir(fpath)
-		if err := os.MkdirAll(dirpath, os.FileMode(dbe.DirPerm)); err != nil {
-			return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	dirpath := filepath.Dir(fpath)
+	if err := dbe.storage.MkdirAll(
+		dirpath, os.FileMode(dbe.DirPerm)); err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+
+	// aquire dir lock with retries
+	if !dbe.locked[dirpath] {
+		release, err := dbe.aquireLock(
+			dirpath, true, dbe.OpTimeout, dbe.OpPolling)
+		if err != nil {
+			return err
 		}
+		defer release()
 	}
 
-	// open file for write
-	f, err := os.OpenFile(
-		fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(dbe.FilePerm))
+	err := dbe.storage.WriteFile(fpath, data, os.FileMode(dbe.FilePerm))
 	if err != nil {
 		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
 	}
-	defer f.Close()
+	return nil
+}
 
-	// aquire file lock with retries
-	if err := dbe.aquireFilelock(
-		f, true, dbe.OpTimeout, dbe.OpPolling); err != nil {
-		return err
+// run fn holding exclusive lock on dir, files written in the dir by the
+// engine passed to fn don't lock the dir again
+func (dbe *FileEngine) WithDirLock(
+	dirpath string, fn func(*FileEngine) error) error {
+	if dbe.ctx.Err() != nil {
+		return ctxError(dbe.ctx)
+	}
+	if dbe.locked[dirpath] {
+		return fn(dbe)
 	}
-	defer dbe.releaseFilelock(f)
 
-	_, err = f.Write(data)
-	if err != nil {
+	// create dir tree if not exist
+	if err := dbe.storage.MkdirAll(
+		dirpath, os.FileMode(dbe.DirPerm)); err != nil {
 		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
 	}
-	return nil
+
+	release, err := dbe.aquireLock(
+		dirpath, true, dbe.OpTimeout, dbe.OpPolling)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return fn(dbe.withLocked(dirpath))
+}
+
+// create copy of engine marking path as locked by the current operation
+func (dbe *FileEngine) withLocked(path string) *FileEngine {
+	e := *dbe
+	e.locked = map[string]bool{path: true}
+	for k, v := range dbe.locked {
+		e.locked[k] = v
+	}
+	return &e
 }
 
 // create file if not exist
@@ -117,25 +172,22 @@ func (dbe *FileEngine) TouchFile(fpath string) error {
 	// create dir tree for file if not exist
 	if !dbe.FileExist(fpath) {
 		dirpath := filepath.Dir(fpath)
-		if err := os.MkdirAll(dirpath, os.FileMode(dbe.DirPerm)); err != nil {
+		if err := dbe.storage.MkdirAll(
+			dirpath, os.FileMode(dbe.DirPerm)); err != nil {
 			return fmt.Errorf("%w - %s", ErrWrite, err.Error())
 		}
 	}
 
-	// open file for write
-	f, err := os.OpenFile(
-		fpath, os.O_WRONLY|os.O_CREATE, os.FileMode(dbe.FilePerm))
+	err := dbe.storage.TouchFile(fpath, os.FileMode(dbe.FilePerm))
 	if err != nil {
 		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
 	}
-	defer f.Close()
-
 	return nil
 }
 
 // delete file
 func (dbe *FileEngine) PurgeFile(fpath string) error {
-	err := os.Remove(fpath)
+	err := dbe.storage.Remove(fpath)
 	if err != nil {
 		return fmt.Errorf("%w%s", ErrError, err.Error())
 	}
@@ -147,38 +199,52 @@ func (dbe *FileEngine) Cancel() {
 	dbe.evtBreak.Set()
 }
 
-// aquire file lock with retries
-func (dbe *FileEngine) aquireFilelock(
-	f *os.File, wr bool, tout, tpoll float64) error {
-	var err error
+// aquire lock on path with retries, returns func to release lock
+func (dbe *FileEngine) aquireLock(
+	path string, wr bool, tout, tpoll float64) (release func(), err error) {
+	start, waited := time.Now(), false
+	defer func() {
+		dbe.metrics.observeLock(start, waited, err)
+		if errors.Is(err, ErrTimeout) {
+			logRecord(dbe.ctx, dbe.logger, slog.LevelWarn, "filedb lock timeout",
+				slog.String("op", "lock"),
+				slog.String("path", path),
+				slog.Duration("duration", time.Since(start)),
+				slog.String("error", err.Error()))
+		}
+	}()
+
 	dbe.evtBreak.Clear()
 	tbreak := float64(time.Now().Unix()) + tout
 	for {
-		if wr {
-			// exclusive lock for writing
-			err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
-		} else {
-			// shared lock for reading
-			err = unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB)
-		}
+		// exclusive lock for writing, shared lock for reading
+		release, err = dbe.storage.TryLock(path, wr)
 		if err == nil {
-			return nil
-		} else if err != unix.EWOULDBLOCK {
-			return fmt.Errorf("%w%s", ErrError, err.Error())
+			return release, nil
+		} else if err != ErrLocked {
+			return nil, fmt.Errorf("%w%s", ErrError, err.Error())
 		} else if tout <= 0 {
-			return ErrLocked
+			return nil, ErrLocked
+		}
+		waited = true
+		select {
+		case <-dbe.ctx.Done():
+			return nil, ctxError(dbe.ctx)
+		case <-time.After(time.Duration(tpoll * 1000000000)):
 		}
-		time.Sleep(time.Duration(tpoll * 1000000000))
 		if dbe.evtBreak.IsSet() {
-			return ErrBreak
+			return nil, ErrBreak
 		}
 		if float64(time.Now().Unix()) >= tbreak {
-			return ErrTimeout
+			return nil, ErrTimeout
 		}
 	}
 }
 
-// release file lock
-func (dbe *FileEngine) releaseFilelock(f *os.File) {
-	unix.Flock(int(f.Fd()), unix.LOCK_UN|unix.LOCK_NB)
+// convert context error to filedb error
+func ctxError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w - %w", ErrTimeout, ctx.Err())
+	}
+	return fmt.Errorf("%w - %w", ErrBreak, ctx.Err())
 }
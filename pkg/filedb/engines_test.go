@@ -0,0 +1,70 @@
+package filedb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestContextCancel(t *testing.T) {
+	dbc, _ := newMemCollection(t, nil)
+	dbc.Query().Set("k", []byte("v"))
+	dbc.Query().Set("c.k", []byte("v"))
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+	}{
+		{"canceled", canceled, ErrBreak},
+		{"deadline", expired, ErrTimeout},
+	}
+	for _, tt := range tests {
+		c := dbc.WithContext(tt.ctx)
+		ops := map[string]func() error{
+			"get":    func() error { _, err := c.Query().Get("k"); return err },
+			"set":    func() error { return c.Query().Set("k", []byte("x")) },
+			"keys":   func() error { _, err := c.Query().Keys(); return err },
+			"childs": func() error { _, err := c.ListChilds(); return err },
+			"copy":   func() error { return c.Copy("c", "d") },
+			"query": func() error {
+				_, err := dbc.Query().WithContext(tt.ctx).Get("k")
+				return err
+			},
+		}
+		for op, fn := range ops {
+			if err := fn(); !errors.Is(err, tt.err) {
+				t.Errorf("%s %s: expected error %v, got %v", tt.name, op, tt.err, err)
+			}
+		}
+	}
+	// collection without context is not affected
+	if value, err := dbc.Query().Get("k"); err != nil || string(value) != "v" {
+		t.Errorf("expected value, got %q %v", value, err)
+	}
+}
+
+func TestContextAbortsLockWait(t *testing.T) {
+	dbc, st := newMemCollection(t, nil)
+	dbc.Query().Set("k", []byte("v"))
+	release, _ := st.TryLock("/db", true)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	q := dbc.WithContext(ctx).Query()
+	q.OpTimeout = 10
+	start := time.Now()
+	if err := q.Set("k", []byte("x")); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("expected lock wait aborted by context")
+	}
+}
@@ -0,0 +1,388 @@
+package filedb
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/exonlabs/go-utils/pkg/crypto/xcipher"
+)
+
+// export formats
+const (
+	ExportTar    = "tar"
+	ExportNDJSON = "ndjson"
+)
+
+// import conflict policies for existing keys
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictFail      = "fail"
+)
+
+// archives hold key values and index marks of a collection tree by their
+// slash separated paths relative to the collection, backups and internal
+// files are not exported. tar archives hold a file per entry, with the
+// expiry time of keys with ttl in a pax record. ndjson archives hold a
+// json record per line.
+const exportExpiryRecord = "FILEDB.expiry"
+
+// export options:
+//
+//	format:  string  archive format, "tar" or "ndjson" (default "tar")
+//	indexes: bool    include indexes (default true)
+//	decrypt: bool    decrypt values with collection cipher, all exported
+//	                 values must be encrypted (default false)
+//	cipher:  xcipher.Cipher  encrypt exported values with cipher, values
+//	                         are decrypted first if decrypt is set
+//
+// import options:
+//
+//	format:   string  archive format, "tar" or "ndjson" (default "tar")
+//	conflict: string  policy for existing keys, "skip", "overwrite" or
+//	                  "fail" (default "fail"). archives are streamed so
+//	                  entries imported before a failing entry are kept.
+//	encrypt:  bool    encrypt imported values with collection cipher
+//	                  (default false)
+
+// archive entry of key value or index mark
+type exportEntry struct {
+	Type   string `json:"type"`
+	Path   string `json:"path"`
+	Value  []byte `json:"value,omitempty"`
+	Expiry int64  `json:"expiry,omitempty"`
+}
+
+// archive entry types
+const (
+	exportKey   = "key"
+	exportIndex = "index"
+)
+
+// write collection tree keys and indexes to archive, the collection is
+// locked exclusively during the export so the archive is consistent.
+// values are exported as stored without repairing corrupted files.
+func (dbc *Collection) Export(w io.Writer, opts Options) (err error) {
+	defer dbc.logOp("export", time.Now(), &err)
+
+	if dbc.keyErr != nil {
+		return dbc.keyErr
+	}
+	x := &exporter{
+		dbc:     dbc,
+		indexes: opts.GetBool("indexes", true),
+		decrypt: opts.GetBool("decrypt", false),
+	}
+	if c, ok := opts.Get("cipher", nil).(xcipher.Cipher); ok {
+		x.cipher = c
+	}
+	if x.decrypt && dbc.cipher == nil {
+		return ErrNoSecurity
+	}
+
+	var flush func() error
+	switch format := opts.GetString("format", ExportTar); format {
+	case ExportTar:
+		tw := tar.NewWriter(w)
+		x.write = func(e *exportEntry) error { return writeTarEntry(tw, e) }
+		flush = func() error {
+			if err := tw.Close(); err != nil {
+				return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+			}
+			return nil
+		}
+	case ExportNDJSON:
+		enc := json.NewEncoder(w)
+		x.write = func(e *exportEntry) error {
+			if err := enc.Encode(e); err != nil {
+				return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+			}
+			return nil
+		}
+		flush = func() error { return nil }
+	default:
+		return fmt.Errorf("%winvalid export format: %s", ErrError, format)
+	}
+
+	err = dbc.withTreeLock(dbc.Query().FileEngine, func(dbq *Query) error {
+		x.dbe = dbq.FileEngine
+		return x.exportDir(dbc.base_path, "", false)
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+type exporter struct {
+	dbc     *Collection
+	dbe     *FileEngine
+	indexes bool
+	decrypt bool
+	cipher  xcipher.Cipher
+	write   func(*exportEntry) error
+}
+
+// export keys of dir then its sub dirs, relpath is the slash separated
+// dir path relative to collection
+func (x *exporter) exportDir(dirpath, relpath string, index bool) error {
+	if x.dbc.ctx.Err() != nil {
+		return ctxError(x.dbc.ctx)
+	}
+	entries, err := x.dbc.storage.ReadDir(dirpath)
+	if err != nil {
+		return fmt.Errorf("%w - %s", ErrRead, err.Error())
+	}
+
+	dbq := &Query{FileEngine: x.dbe, collection: x.dbc.sub(dirpath)}
+	for _, e := range entries {
+		n := e.Name()
+		key, ok := x.dbc.nameKey(n)
+		switch {
+		case e.IsDir() && strings.HasPrefix(n, ".ix_"):
+			if x.indexes && !index {
+				err = x.exportDir(
+					filepath.Join(dirpath, n), path.Join(relpath, n), true)
+			}
+		case e.IsDir() && ok:
+			err = x.exportDir(
+				filepath.Join(dirpath, n), path.Join(relpath, n), index)
+		case !ok || !e.Type().IsRegular():
+		case index:
+			err = x.write(
+				&exportEntry{Type: exportIndex, Path: path.Join(relpath, n)})
+		default:
+			err = x.exportKey(dbq, key, path.Join(relpath, n))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// export key value read from main file falling back to backup file,
+// expired keys are skipped
+func (x *exporter) exportKey(dbq *Query, key, relpath string) error {
+	keypath := dbq.collection.keyPath(key)
+	var rawdata, value []byte
+	var flags uint8
+	err := ErrNotExist
+	for _, p := range []string{keypath, keyBakPath(keypath)} {
+		if !dbq.FileExist(p) {
+			continue
+		}
+		if rawdata, err = dbq.ReadFile(p); err == nil {
+			if value, flags, err = dbq.collection.decodeValue(rawdata); err == nil {
+				break
+			}
+		}
+	}
+	if errors.Is(err, ErrNotExist) || recordExpired(rawdata, flags) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if x.decrypt {
+		if value, err = dbq.decrypt(key, value); err != nil {
+			return err
+		}
+	}
+	if x.cipher != nil {
+		if value, err = x.cipher.Encrypt(value); err != nil {
+			return fmt.Errorf("%w%s", ErrEncrypt, err.Error())
+		}
+	}
+
+	e := &exportEntry{Type: exportKey, Path: relpath, Value: value}
+	if flags&recordFlagTTL != 0 {
+		expiry, _ := recordExpiry(rawdata)
+		e.Expiry = expiry.UnixNano()
+	}
+	return x.write(e)
+}
+
+func writeTarEntry(tw *tar.Writer, e *exportEntry) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     e.Path,
+		Size:     int64(len(e.Value)),
+		Mode:     int64(defaultFilePerm),
+		ModTime:  time.Now(),
+	}
+	if e.Expiry != 0 {
+		hdr.Format = tar.FormatPAX
+		hdr.PAXRecords = map[string]string{
+			exportExpiryRecord: strconv.FormatInt(e.Expiry, 10)}
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+	if _, err := tw.Write(e.Value); err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+	return nil
+}
+
+// read keys and indexes from archive into collection
+func (dbc *Collection) Import(r io.Reader, opts Options) (err error) {
+	defer dbc.logOp("import", time.Now(), &err)
+
+	if dbc.keyErr != nil {
+		return dbc.keyErr
+	}
+	encrypt := opts.GetBool("encrypt", false)
+	if encrypt && dbc.cipher == nil {
+		return ErrNoSecurity
+	}
+	conflict := opts.GetString("conflict", ConflictFail)
+	switch conflict {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+	default:
+		return fmt.Errorf("%winvalid conflict policy: %s", ErrError, conflict)
+	}
+
+	var next func() (*exportEntry, error)
+	switch format := opts.GetString("format", ExportTar); format {
+	case ExportTar:
+		tr := tar.NewReader(r)
+		next = func() (*exportEntry, error) { return readTarEntry(tr) }
+	case ExportNDJSON:
+		dec := json.NewDecoder(bufio.NewReader(r))
+		next = func() (*exportEntry, error) {
+			var e exportEntry
+			if err := dec.Decode(&e); err != nil {
+				return nil, err
+			}
+			return &e, nil
+		}
+	default:
+		return fmt.Errorf("%winvalid import format: %s", ErrError, format)
+	}
+
+	for {
+		if dbc.ctx.Err() != nil {
+			return ctxError(dbc.ctx)
+		}
+		e, err := next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w - %s", ErrRead, err.Error())
+		}
+		if e == nil {
+			continue
+		}
+		if err := dbc.importEntry(e, conflict, encrypt); err != nil {
+			return err
+		}
+	}
+}
+
+// read next tar entry, non regular entries are returned as nil
+func readTarEntry(tr *tar.Reader) (*exportEntry, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil, nil
+	}
+	value, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, err
+	}
+	e := &exportEntry{Type: exportKey, Path: hdr.Name, Value: value}
+	if s, ok := hdr.PAXRecords[exportExpiryRecord]; ok {
+		if e.Expiry, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// write archive entry to collection, entry paths are validated to
+// resolve to keys or index marks inside the collection
+func (dbc *Collection) importEntry(
+	e *exportEntry, conflict string, encrypt bool) error {
+	segs := strings.Split(e.Path, "/")
+	if slices.Contains(segs, "") {
+		return fmt.Errorf("%w - invalid entry path: %q", ErrKeyFormat, e.Path)
+	}
+	index, prefix := false, ""
+	for _, s := range segs[:len(segs)-1] {
+		if ix, ok := strings.CutPrefix(s, ".ix_"); ok && !index {
+			// index dirs hold a single index name segment
+			if strings.Contains(ix, keySep) || ValidateKey(ix) != nil {
+				return fmt.Errorf("%w - invalid entry path: %q", ErrKeyFormat, e.Path)
+			}
+			index = true
+		} else if k, ok := dbc.nameKey(s); !ok {
+			return fmt.Errorf("%w - invalid entry path: %q", ErrKeyFormat, e.Path)
+		} else if !index {
+			prefix += k + keySep
+		}
+	}
+	name := segs[len(segs)-1]
+	key, ok := dbc.nameKey(name)
+	if !ok {
+		return fmt.Errorf("%w - invalid entry path: %q", ErrKeyFormat, e.Path)
+	}
+
+	dirpath := filepath.Join(
+		append([]string{dbc.base_path}, segs[:len(segs)-1]...)...)
+	c := dbc.sub(dirpath)
+	// hooks get keys relative to the root collection
+	c.keyPrefix += prefix
+	dbq := c.Query()
+	if e.Type == exportIndex && !index {
+		return fmt.Errorf("%w - invalid index entry path: %q", ErrKeyFormat, e.Path)
+	}
+	if index {
+		release, err := dbq.lockKey(key, lockShared)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return dbq.TouchFile(filepath.Join(dirpath, name))
+	}
+
+	if dbq.IsExist(key) {
+		switch conflict {
+		case ConflictSkip:
+			return nil
+		case ConflictFail:
+			return fmt.Errorf("%w - %s", ErrExist, e.Path)
+		}
+	}
+
+	value := e.Value
+	if encrypt {
+		b, err := dbc.cipher.Encrypt(value)
+		if err != nil {
+			return fmt.Errorf("%w%s", ErrEncrypt, err.Error())
+		}
+		value = b
+	}
+	if e.Expiry != 0 {
+		if time.Now().UnixNano() >= e.Expiry {
+			return nil
+		}
+		if err := dbc.checkTTL(); err != nil {
+			return err
+		}
+		return dbq.write(key, encodeExpiringRecord(value, time.Unix(0, e.Expiry)))
+	}
+	return dbq.Set(key, value)
+}
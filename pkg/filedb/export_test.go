@@ -0,0 +1,122 @@
+package filedb
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fill collection with keys, child keys, index marks and expiring keys
+func fillExportCollection(t *testing.T, dbc *Collection) {
+	t.Helper()
+	q := dbc.Query()
+	q.Set("a", []byte("1"))
+	q.SetBuffer("c.k", Buffer{"x": 1})
+	q.SetWithTTL("t", []byte("ttl"), time.Hour)
+	q.write("gone", encodeExpiringRecord([]byte("g"), time.Now().Add(-time.Second)))
+	dbc.Index("ix").Mark("a")
+	dbc.Child("c").Index("sub").Mark("k")
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []string{ExportTar, ExportNDJSON} {
+		src, _ := newMemCollection(t, Options{"checksum": true})
+		fillExportCollection(t, src)
+
+		var buf bytes.Buffer
+		if err := src.Export(&buf, Options{"format": format}); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		dst, st := newMemCollection(t, Options{"checksum": true})
+		if err := dst.Import(&buf, Options{"format": format}); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		q := dst.Query()
+		keys, _ := q.Keys()
+		if !slices.Equal(keys, []string{"a", "t"}) {
+			t.Errorf("%s: expected imported keys, got %v", format, keys)
+		}
+		if value, err := q.Get("c.k"); err != nil || !bytes.Contains(value, []byte(`"x": 1`)) {
+			t.Errorf("%s: expected child key, got %q %v", format, value, err)
+		}
+		rawdata, _ := st.ReadFile("/db/t")
+		if _, ok := recordExpiry(rawdata); !ok {
+			t.Errorf("%s: expected imported key to keep its expiry", format)
+		}
+		if !dst.Index("ix").Check("a") || !dst.Child("c").Index("sub").Check("k") {
+			t.Errorf("%s: expected imported index marks", format)
+		}
+	}
+}
+
+func TestExportRaw(t *testing.T) {
+	dbc, st := newMemCollection(t, Options{"checksum": true})
+	dbc.Query().Set("a", []byte("good"))
+	corrupt := []byte("FDBRcorrupted record")
+	st.WriteFile("/db/a", corrupt, 0o664)
+
+	var buf bytes.Buffer
+	if err := dbc.Export(&buf, Options{"format": ExportNDJSON}); err != nil {
+		t.Fatal(err)
+	}
+	// export reads the valid backup without repairing the main file
+	if !strings.Contains(buf.String(), `"value":"Z29vZA=="`) {
+		t.Errorf("expected backup value exported, got %s", buf.String())
+	}
+	checkFile(t, st, "/db/a", corrupt)
+}
+
+func TestImportConflicts(t *testing.T) {
+	tests := []struct {
+		conflict string
+		err      error
+		value    string
+	}{
+		{ConflictSkip, nil, "old"},
+		{ConflictOverwrite, nil, "new"},
+		{ConflictFail, ErrExist, "old"},
+	}
+	archive := `{"type":"key","path":"k","value":"bmV3"}` + "\n"
+	for _, tt := range tests {
+		dbc, _ := newMemCollection(t, nil)
+		q := dbc.Query()
+		q.Set("k", []byte("old"))
+		err := dbc.Import(strings.NewReader(archive),
+			Options{"format": ExportNDJSON, "conflict": tt.conflict})
+		if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+			t.Errorf("%s: expected error %v, got %v", tt.conflict, tt.err, err)
+		}
+		if value, _ := q.Get("k"); string(value) != tt.value {
+			t.Errorf("%s: expected %q, got %q", tt.conflict, tt.value, value)
+		}
+	}
+}
+
+func TestImportBadEntries(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+	}{
+		{"parent path", `{"type":"key","path":"../x","value":"MQ=="}`},
+		{"absolute path", `{"type":"key","path":"/x","value":"MQ=="}`},
+		{"internal name", `{"type":"key","path":".bak/x","value":"MQ=="}`},
+		{"invalid index name", `{"type":"index","path":".ix_a.b/x"}`},
+		{"index outside index dir", `{"type":"index","path":"c/x"}`},
+		{"index at root", `{"type":"index","path":"x"}`},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(t, nil)
+		err := dbc.Import(strings.NewReader(tt.entry+"\n"),
+			Options{"format": ExportNDJSON})
+		if !errors.Is(err, ErrKeyFormat) {
+			t.Errorf("%s: expected key format error, got %v", tt.name, err)
+		}
+		if _, err := st.Stat("/db/x"); err == nil {
+			t.Errorf("%s: unexpected file written", tt.name)
+		}
+	}
+}
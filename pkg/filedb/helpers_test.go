@@ -0,0 +1,37 @@
+package filedb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// create collection on empty in-memory storage with options
+func newMemCollection(t *testing.T, opts Options) (*Collection, *MemStorage) {
+	t.Helper()
+	st := NewMemStorage()
+	dbc, err := NewCollection("/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbc.InitStorage(st)
+	if err := dbc.UpdateOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	return dbc, st
+}
+
+// check storage file content
+func checkFile(t *testing.T, st *MemStorage, path string, want []byte) {
+	t.Helper()
+	data, err := st.ReadFile(path)
+	if want == nil {
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: expected no file, got %q %v", path, data, err)
+		}
+		return
+	}
+	if err != nil || !bytes.Equal(data, want) {
+		t.Errorf("%s: expected %q, got %q %v", path, want, data, err)
+	}
+}
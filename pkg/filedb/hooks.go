@@ -0,0 +1,151 @@
+package filedb
+
+import (
+	"strings"
+	"sync"
+)
+
+// change hooks are called synchronously after successful operations in
+// the calling goroutine. hooks are kept in a single registry shared by
+// the root collection and all its child collections, indexes and copies.
+// hooks registered on a collection are called for changes of keys in the
+// collection and its child collections, keys and index names are passed
+// as full keys relative to the root collection. values passed to hooks
+// are the stored values, encrypted values are passed encrypted.
+type hooks struct {
+	mu         sync.RWMutex
+	set        []hook[func(key string, oldvalue, newvalue []byte)]
+	delete     []hook[func(key string, oldvalue []byte)]
+	indexMark  []hook[func(index, key string)]
+	indexClear []hook[func(index, key string)]
+}
+
+// hook function with path of collection it is registered on
+type hook[F any] struct {
+	path string
+	fn   F
+}
+
+// register hook called after key writes with the previous value, the
+// previous value is nil if the key did not exist
+func (dbc *Collection) OnSet(fn func(key string, oldvalue, newvalue []byte)) {
+	dbc.hooks.mu.Lock()
+	defer dbc.hooks.mu.Unlock()
+	dbc.hooks.set = append(dbc.hooks.set, hook[func(
+		string, []byte, []byte)]{dbc.base_path, fn})
+}
+
+// register hook called after existing keys are deleted
+func (dbc *Collection) OnDelete(fn func(key string, oldvalue []byte)) {
+	dbc.hooks.mu.Lock()
+	defer dbc.hooks.mu.Unlock()
+	dbc.hooks.delete = append(dbc.hooks.delete, hook[func(
+		string, []byte)]{dbc.base_path, fn})
+}
+
+// register hook called after keys are marked in collection indexes
+func (dbc *Collection) OnIndexMark(fn func(index, key string)) {
+	dbc.hooks.mu.Lock()
+	defer dbc.hooks.mu.Unlock()
+	dbc.hooks.indexMark = append(dbc.hooks.indexMark, hook[func(
+		string, string)]{dbc.base_path, fn})
+}
+
+// register hook called after keys are cleared from collection indexes
+func (dbc *Collection) OnIndexClear(fn func(index, key string)) {
+	dbc.hooks.mu.Lock()
+	defer dbc.hooks.mu.Unlock()
+	dbc.hooks.indexClear = append(dbc.hooks.indexClear, hook[func(
+		string, string)]{dbc.base_path, fn})
+}
+
+// get hook functions registered on collection or its parents
+func collectionHooks[F any](dbc *Collection, hs []hook[F]) []F {
+	fns := []F{}
+	for _, h := range hs {
+		if dbc.base_path == h.path ||
+			strings.HasPrefix(dbc.base_path, h.path+fileSep) {
+			fns = append(fns, h.fn)
+		}
+	}
+	return fns
+}
+
+// check if set or delete hooks need previous values
+func (dbc *Collection) hasSetHooks() bool {
+	if dbc.hooks == nil {
+		return false
+	}
+	dbc.hooks.mu.RLock()
+	defer dbc.hooks.mu.RUnlock()
+	return len(collectionHooks(dbc, dbc.hooks.set)) > 0
+}
+func (dbc *Collection) hasDeleteHooks() bool {
+	if dbc.hooks == nil {
+		return false
+	}
+	dbc.hooks.mu.RLock()
+	defer dbc.hooks.mu.RUnlock()
+	return len(collectionHooks(dbc, dbc.hooks.delete)) > 0
+}
+
+func (dbc *Collection) fireSet(key string, oldvalue, newvalue []byte) {
+	if dbc.hooks == nil {
+		return
+	}
+	dbc.hooks.mu.RLock()
+	fns := collectionHooks(dbc, dbc.hooks.set)
+	dbc.hooks.mu.RUnlock()
+	for _, fn := range fns {
+		fn(dbc.keyPrefix+key, oldvalue, newvalue)
+	}
+}
+
+func (dbc *Collection) fireDelete(key string, oldvalue []byte) {
+	if dbc.hooks == nil {
+		return
+	}
+	dbc.hooks.mu.RLock()
+	fns := collectionHooks(dbc, dbc.hooks.delete)
+	dbc.hooks.mu.RUnlock()
+	for _, fn := range fns {
+		fn(dbc.keyPrefix+key, oldvalue)
+	}
+}
+
+func (dbc *Collection) fireIndexMark(index, key string) {
+	if dbc.hooks == nil {
+		return
+	}
+	dbc.hooks.mu.RLock()
+	fns := collectionHooks(dbc, dbc.hooks.indexMark)
+	dbc.hooks.mu.RUnlock()
+	for _, fn := range fns {
+		fn(dbc.keyPrefix+index, dbc.keyPrefix+key)
+	}
+}
+
+func (dbc *Collection) fireIndexClear(index, key string) {
+	if dbc.hooks == nil {
+		return
+	}
+	dbc.hooks.mu.RLock()
+	fns := collectionHooks(dbc, dbc.hooks.indexClear)
+	dbc.hooks.mu.RUnlock()
+	for _, fn := range fns {
+		fn(dbc.keyPrefix+index, dbc.keyPrefix+key)
+	}
+}
+
+// read stored value of key file for hooks, nil if missing or invalid
+func (dbq *Query) hookValue(keypath string) []byte {
+	rawdata, err := dbq.ReadFile(keypath)
+	if err != nil {
+		return nil
+	}
+	payload, flags, err := dbq.collection.decodeValue(rawdata)
+	if err != nil || recordExpired(rawdata, flags) {
+		return nil
+	}
+	return payload
+}
@@ -0,0 +1,77 @@
+package filedb
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// register hooks on collection recording events
+func recordHooks(dbc *Collection, events *[]string) {
+	dbc.OnSet(func(key string, oldvalue, newvalue []byte) {
+		*events = append(*events,
+			fmt.Sprintf("set %s %s %s", key, oldvalue, newvalue))
+	})
+	dbc.OnDelete(func(key string, oldvalue []byte) {
+		*events = append(*events, fmt.Sprintf("del %s %s", key, oldvalue))
+	})
+	dbc.OnIndexMark(func(index, key string) {
+		*events = append(*events, fmt.Sprintf("mark %s %s", index, key))
+	})
+	dbc.OnIndexClear(func(index, key string) {
+		*events = append(*events, fmt.Sprintf("clear %s %s", index, key))
+	})
+}
+
+func TestHooks(t *testing.T) {
+	dbc, _ := newMemCollection(t, nil)
+	root, child := []string{}, []string{}
+	recordHooks(dbc, &root)
+	recordHooks(dbc.Child("users"), &child)
+
+	q := dbc.Query()
+	q.Set("k", []byte("1"))
+	q.Set("k", []byte("2"))
+	q.Delete("k")
+	q.Delete("k")
+	// hooks registered through another copy of the child are shared
+	uq := dbc.Child("users").Query()
+	uq.Set("x", []byte("a"))
+	dbc.Child("users").Index("ix").Mark("x")
+	dbc.Child("users").Index("ix").Clear("x")
+	dbc.Child("users").Index("ix").Clear("x")
+	uq.Delete("x")
+	dbc.Child("users").Child("sub").Query().Set("y", []byte("b"))
+
+	wantChild := []string{
+		"set users.x  a",
+		"mark users.ix users.x",
+		"clear users.ix users.x",
+		"del users.x a",
+		"set users.sub.y  b",
+	}
+	wantRoot := append([]string{"set k  1", "set k 1 2", "del k 2"}, wantChild...)
+	if !slices.Equal(root, wantRoot) {
+		t.Errorf("unexpected root events:\n%s", strings.Join(root, "\n"))
+	}
+	if !slices.Equal(child, wantChild) {
+		t.Errorf("unexpected child events:\n%s", strings.Join(child, "\n"))
+	}
+}
+
+func TestHooksOnImport(t *testing.T) {
+	dbc, _ := newMemCollection(t, nil)
+	events := []string{}
+	recordHooks(dbc.Child("c"), &events)
+	archive := `{"type":"key","path":"a","value":"MQ=="}` + "\n" +
+		`{"type":"key","path":"c/k","value":"Mg=="}` + "\n" +
+		`{"type":"index","path":"c/.ix_ix/k"}` + "\n"
+	if err := dbc.Import(strings.NewReader(archive),
+		Options{"format": ExportNDJSON}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(events, []string{"set c.k  2"}) {
+		t.Errorf("unexpected events %v", events)
+	}
+}
@@ -1,11 +1,13 @@
 package filedb
 
-import (
-	"os"
-)
+import "path/filepath"
 
 type Index struct {
 	collection *Collection
+
+	// index name and parent collection firing index hooks
+	name   string
+	parent *Collection
 }
 
 func (indx *Index) List() ([]string, error) {
@@ -21,25 +23,79 @@ func (indx *Index) Check(key string) bool {
 }
 
 func (indx *Index) Mark(key string) error {
-	fpath := indx.collection.KeyPath(key)
-	return indx.collection.Query().TouchFile(fpath)
+	return indx.mark(indx.collection.Query(), key)
 }
 
 func (indx *Index) Clear(key string) error {
-	return indx.collection.Query().Delete(key)
+	return indx.clear(indx.collection.Query(), key)
+}
+
+// create index mark file holding the index collection locks
+func (indx *Index) mark(dbq *Query, key string) error {
+	if err := indx.collection.checkKey(key); err != nil {
+		return err
+	}
+	release, err := dbq.lockKey(key, lockShared)
+	if err != nil {
+		return err
+	}
+	err = dbq.TouchFile(indx.collection.keyPath(key))
+	release()
+	if err != nil {
+		return err
+	}
+	indx.parent.fireIndexMark(indx.name, key)
+	return nil
+}
+
+// remove index mark file
+func (indx *Index) clear(dbq *Query, key string) error {
+	return indx.clearMark(dbq, indx.name, key)
+}
+
+// remove mark file of named index, clear hooks are fired only if the
+// mark existed
+func (indx *Index) clearMark(dbq *Query, name, key string) error {
+	existed, _, err := dbq.delete(key)
+	if err != nil {
+		return err
+	}
+	if existed {
+		indx.parent.fireIndexClear(name, key)
+	}
+	return nil
+}
+
+// create index collection query using engine of the current operation
+func (indx *Index) query(dbe *FileEngine) *Query {
+	return &Query{FileEngine: dbe, collection: indx.collection}
 }
 
 func (indx *Index) ClearAll(key string) error {
+	if err := indx.collection.checkKey(key); err != nil {
+		return err
+	}
 	indxlist, err := indx.ListIndexes()
 	if err != nil {
 		return err
 	}
 	for _, ix := range indxlist {
-		indx.collection.Query().Delete(ix + keySep + key)
+		sub := indx.collection.sub(filepath.Join(indx.collection.base_path, ix))
+		indx.clearMark(sub.Query(), indx.name+keySep+ix, key)
 	}
 	return nil
 }
 
 func (indx *Index) Purge() error {
-	return os.RemoveAll(indx.collection.base_path)
+	if indx.collection.keyErr != nil {
+		return indx.collection.keyErr
+	}
+	release, err := indx.collection.lockStructure(
+		indx.collection.Query().FileEngine)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return indx.collection.storage.RemoveAll(indx.collection.base_path)
 }
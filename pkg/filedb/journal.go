@@ -0,0 +1,206 @@
+package filedb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// journal entries are stored as checksummed records in a hidden dir of
+// the collection before multi-step operations and removed once the
+// operation completes. unfinished entries are processed by Recover.
+const (
+	journalDir    = ".journal"
+	journalSuffix = ".jrn"
+)
+
+// journal entry types
+const (
+	journalTx      = "tx"
+	journalCopy    = "copy"
+	journalMove    = "move"
+	journalSet     = "set"
+	journalRestore = "restore"
+	journalMoveKey = "move_key"
+
+	// move phase after copy is complete
+	journalPhasePurge = "purge"
+	// restore phase after current content is removed
+	journalPhaseSwap = "swap"
+	// key move writing value converted for destination collection
+	journalPhaseWrite = "write"
+	// transaction undo after failed commit
+	journalPhaseUndo = "undo"
+)
+
+// journal entry, src and dst paths are relative to collection. the dst
+// of key moves is the key path in the destination collection which may
+// resolve outside the collection but always within its root collection.
+type journalEntry struct {
+	Type  string `json:"type"`
+	Key   string `json:"key,omitempty"`
+	Src   string `json:"src,omitempty"`
+	Dst   string `json:"dst,omitempty"`
+	Phase string `json:"phase,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Ops   []txOp `json:"ops,omitempty"`
+}
+
+// complete or undo unfinished operations logged in collection journal,
+// must be called after opening a collection that may have been
+// interrupted by a crash or power loss, journals are never processed
+// automatically. the collection is locked
+// exclusively while recovering, operations logging in the journal hold
+// the collection lock until done so entries of operations still in
+// progress are never processed.
+func (dbc *Collection) Recover() error {
+	if dbc.keyErr != nil {
+		return dbc.keyErr
+	}
+	return dbc.withTreeLock(dbc.Query().FileEngine, dbc.recoverJournal)
+}
+
+// process all journal entries holding the collection exclusive lock
+func (dbc *Collection) recoverJournal(dbq *Query) error {
+	entries, err := dbc.storage.ReadDir(dbc.journalPath(""))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), journalSuffix) {
+			continue
+		}
+		jpath := dbc.journalPath(e.Name())
+		entry, err := dbc.readJournal(dbq, jpath)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		err = dbc.recoverEntry(dbq, jpath, entry)
+		dbc.logOp("recover", start, &err,
+			slog.String("type", entry.Type),
+			slog.String("key", entry.Key),
+			slog.String("src", entry.Src),
+			slog.String("dst", entry.Dst))
+		if err != nil {
+			return err
+		}
+		dbc.metrics.inc(MetricJournalRecoveries)
+		if err := dbq.PurgeFile(jpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// process unfinished journal entry
+func (dbc *Collection) recoverEntry(
+	dbq *Query, jpath string, entry *journalEntry) error {
+	switch entry.Type {
+	case journalTx:
+		// failed commits are undone, interrupted commits are replayed,
+		// all ops are idempotent
+		if entry.Phase == journalPhaseUndo {
+			return dbc.undoTxOps(dbq, entry.Ops)
+		}
+		return dbc.applyTxOps(dbq, entry.Ops)
+	case journalCopy:
+		// partial copies are removed
+		return dbc.removeRel(entry.Dst)
+	case journalMove:
+		// partial copies are removed, completed copies are purged
+		if entry.Phase == journalPhasePurge {
+			return dbc.removeRel(entry.Src)
+		}
+		return dbc.removeRel(entry.Dst)
+	case journalSet:
+		// main and backup files are synced from the valid copy
+		return dbq.repair(entry.Key)
+	case journalMoveKey:
+		// remaining key files are moved to destination
+		return dbq.moveKeyFiles(entry)
+	case journalRestore:
+		// staged snapshot content is swapped in
+		return dbc.restoreStaged(dbq, jpath, entry)
+	}
+	return fmt.Errorf("%winvalid journal entry type: %s", ErrError, entry.Type)
+}
+
+// get path relative to collection path, collection copy and move
+// entries are logged with relative paths as encoded keys can't express
+// nested collections. paths of other collections under the same root
+// collection are relative to collection path with parent elements.
+func (dbc *Collection) relPath(path string) string {
+	if relpath, err := filepath.Rel(dbc.base_path, path); err == nil {
+		return relpath
+	}
+	return path
+}
+
+// remove tree at path relative to collection path
+func (dbc *Collection) removeRel(relpath string) error {
+	path, err := dbc.relJoin(relpath)
+	if err != nil {
+		return err
+	}
+	return dbc.storage.RemoveAll(path)
+}
+
+// get path of journal entry path relative to collection path, paths
+// resolving outside the root collection are rejected
+func (dbc *Collection) relJoin(relpath string) (string, error) {
+	path := filepath.Join(dbc.base_path, relpath)
+	if !strings.HasPrefix(path, dbc.root_path+fileSep) {
+		return "", fmt.Errorf(
+			"%winvalid journal entry path: %s", ErrError, relpath)
+	}
+	return path, nil
+}
+
+// get path of file in journal dir
+func (dbc *Collection) journalPath(name string) string {
+	return filepath.Join(dbc.base_path, journalDir, name)
+}
+
+// get path for new journal entry, names are time ordered to process
+// entries in order
+func (dbc *Collection) newJournalPath(typ string) string {
+	return dbc.journalPath(fmt.Sprintf("%016x%08x_%s%s",
+		time.Now().UnixNano(), rand.Uint32(), typ, journalSuffix))
+}
+
+// write or update journal entry
+func (dbc *Collection) writeJournal(
+	dbq *Query, jpath string, entry *journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+	return dbq.WriteFile(jpath, encodeRecord(data, 0))
+}
+
+// read and verify journal entry
+func (dbc *Collection) readJournal(
+	dbq *Query, jpath string) (*journalEntry, error) {
+	rawdata, err := dbq.ReadFile(jpath)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := decodeRecord(rawdata)
+	if err != nil {
+		return nil, err
+	}
+	var entry journalEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("%w - %s", ErrCorrupt, err.Error())
+	}
+	return &entry, nil
+}
@@ -0,0 +1,242 @@
+package filedb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// key copy options:
+//
+//	overwrite: bool  replace existing destination key (default false)
+//	secure:    bool  value is encrypted, it is re-encrypted if source and
+//	                 destination collections use different ciphers
+//
+// values are copied as stored records keeping their ttl, records are
+// converted if the destination collection uses a different record
+// format or cipher.
+
+// copy key value to dstkey in dst collection
+func (dbq *Query) CopyKey(
+	srckey string, dst *Collection, dstkey string, opts Options) error {
+	reencrypt, err := dbq.reencrypt(dst, opts)
+	if err != nil {
+		return err
+	}
+	rawdata, err := dbq.readKey(srckey, func([]byte) error { return nil })
+	if err != nil {
+		return err
+	}
+	if rawdata, err = dbq.convertRecord(
+		srckey, rawdata, dst, reencrypt); err != nil {
+		return err
+	}
+
+	dstq := dst.Query()
+	dstq.OpTimeout, dstq.OpPolling = dbq.OpTimeout, dbq.OpPolling
+	return dstq.withKeyLock(dstkey, func(q *Query) error {
+		if !opts.GetBool("overwrite", false) && q.IsExist(dstkey) {
+			return ErrExist
+		}
+		return q.write(dstkey, rawdata)
+	})
+}
+
+// move key value with its backup files to dstkey in dst collection.
+// moves within the same root collection are logged in the source
+// collection journal and completed by Recover on crash, key files are
+// renamed unless the record is converted for the destination, then the
+// backup generations are dropped. moves to other root collections or
+// storage backends copy the value then delete the source key and are
+// not journaled.
+func (dbq *Query) MoveKey(
+	srckey string, dst *Collection, dstkey string, opts Options) error {
+	src := dbq.collection
+	if dst.storage == src.storage && dst.root_path == src.root_path {
+		return dbq.moveKey(srckey, dst, dstkey, opts)
+	}
+	if err := dbq.CopyKey(srckey, dst, dstkey, opts); err != nil {
+		return err
+	}
+	return dbq.Delete(srckey)
+}
+
+// rename key with its backup files within the collection
+func (dbq *Query) RenameKey(srckey, dstkey string, opts Options) error {
+	return dbq.moveKey(srckey, dbq.collection, dstkey, opts)
+}
+
+// move key files to dstkey in dst collection sharing the storage, set
+// hooks of destination and delete hooks of source are fired
+func (dbq *Query) moveKey(
+	srckey string, dst *Collection, dstkey string, opts Options) error {
+	src := dbq.collection
+	if err := src.checkKey(srckey); err != nil {
+		return err
+	}
+	if err := dst.checkKey(dstkey); err != nil {
+		return err
+	}
+	srcpath, dstpath := src.keyPath(srckey), dst.keyPath(dstkey)
+	if srcpath == dstpath {
+		return nil
+	}
+	reencrypt, err := dbq.reencrypt(dst, opts)
+	if err != nil {
+		return err
+	}
+
+	var srcvalue, value, oldvalue []byte
+	err = dbq.withKeysLock([]*Collection{src, dst}, []string{srckey, dstkey},
+		func(dbe *FileEngine) error {
+			q := &Query{FileEngine: dbe, collection: src}
+			dq := &Query{FileEngine: dbe, collection: dst}
+			if !q.IsExist(srckey) {
+				return ErrNotExist
+			}
+			if !opts.GetBool("overwrite", false) && dq.IsExist(dstkey) {
+				return ErrExist
+			}
+
+			entry := &journalEntry{
+				Type: journalMoveKey, Src: src.relPath(srcpath), Dst: src.relPath(dstpath)}
+			if reencrypt || src.checksum != dst.checksum {
+				rawdata, err := q.readKey(srckey, func([]byte) error { return nil })
+				if err != nil {
+					return err
+				}
+				entry.Value, err = q.convertRecord(srckey, rawdata, dst, reencrypt)
+				if err != nil {
+					return err
+				}
+				entry.Phase = journalPhaseWrite
+			}
+			if src.hasDeleteHooks() || dst.hasSetHooks() {
+				srcvalue = q.hookValue(srcpath)
+				value = srcvalue
+				if entry.Value != nil {
+					value, _, _ = dst.decodeValue(entry.Value)
+				}
+				oldvalue = dq.hookValue(dstpath)
+			}
+
+			// stale backups of replaced key are removed
+			if err := dq.purgeBackups(dstpath); err != nil {
+				return err
+			}
+			jpath := src.newJournalPath(journalMoveKey)
+			if err := src.writeJournal(q, jpath, entry); err != nil {
+				return err
+			}
+			if err := q.moveKeyFiles(entry); err != nil {
+				return err
+			}
+			return q.PurgeFile(jpath)
+		})
+	if err != nil {
+		return err
+	}
+
+	dst.fireSet(dstkey, oldvalue, value)
+	src.fireDelete(srckey, srcvalue)
+	return nil
+}
+
+// move key files logged in journal entry, the source and destination
+// paths are relative to collection. values converted for the destination
+// are written from the entry then the source files are removed, else all
+// key files are renamed.
+func (dbq *Query) moveKeyFiles(entry *journalEntry) error {
+	srcpath, err := dbq.collection.relJoin(entry.Src)
+	if err != nil {
+		return err
+	}
+	dstpath, err := dbq.collection.relJoin(entry.Dst)
+	if err != nil {
+		return err
+	}
+	if entry.Phase != journalPhaseWrite {
+		if err := dbq.renameKeyPaths(srcpath, dstpath); err != nil {
+			return err
+		}
+		return dbq.purgeLegacyBackup(srcpath)
+	}
+
+	for _, p := range []string{dstpath, keyBakPath(dstpath)} {
+		if err := dbq.WriteFile(p, entry.Value); err != nil {
+			return err
+		}
+	}
+	if err := dbq.purgeBackups(srcpath); err != nil {
+		return err
+	}
+	if dbq.FileExist(srcpath) {
+		return dbq.PurgeFile(srcpath)
+	}
+	return nil
+}
+
+// rename existing key files, backup files are renamed before the main
+// file so an interrupted rename never loses the value
+func (dbq *Query) renameKeyPaths(srcpath, dstpath string) error {
+	gens, _ := dbq.keyGenerations(srcpath)
+	paths := [][2]string{}
+	for i := len(gens) - 1; i >= 0; i-- {
+		paths = append(paths, [2]string{
+			keyGenPath(srcpath, gens[i]), keyGenPath(dstpath, gens[i])})
+	}
+	paths = append(paths,
+		[2]string{keyBakPath(srcpath), keyBakPath(dstpath)},
+		[2]string{srcpath, dstpath})
+
+	for _, p := range paths {
+		if !dbq.FileExist(p[0]) {
+			continue
+		}
+		if err := dbq.storage.MkdirAll(
+			filepath.Dir(p[1]), os.FileMode(dbq.DirPerm)); err != nil {
+			return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+		}
+		if err := dbq.storage.Rename(p[0], p[1]); err != nil {
+			return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+		}
+	}
+	return nil
+}
+
+// check if values need re-encryption for dst collection
+func (dbq *Query) reencrypt(dst *Collection, opts Options) (bool, error) {
+	if !opts.GetBool("secure", false) || dbq.collection.cipher == dst.cipher {
+		return false, nil
+	}
+	if dbq.collection.cipher == nil || dst.cipher == nil {
+		return false, ErrNoSecurity
+	}
+	return true, nil
+}
+
+// convert raw record of key to dst collection record format keeping its
+// expiry time, the value is re-encrypted with dst cipher if reencrypt
+func (dbq *Query) convertRecord(key string, rawdata []byte,
+	dst *Collection, reencrypt bool) ([]byte, error) {
+	value, flags, err := dbq.collection.decodeValue(rawdata)
+	if err != nil {
+		return nil, err
+	}
+	if reencrypt {
+		if value, err = dbq.decrypt(key, value); err != nil {
+			return nil, err
+		}
+		if value, err = dst.cipher.Encrypt(value); err != nil {
+			return nil, fmt.Errorf("%w%s", ErrEncrypt, err.Error())
+		}
+	}
+	if flags&recordFlagTTL != 0 {
+		if err := dst.checkTTL(); err != nil {
+			return nil, err
+		}
+		expiry, _ := recordExpiry(rawdata)
+		return encodeExpiringRecord(value, expiry), nil
+	}
+	return dst.encodeValue(value), nil
+}
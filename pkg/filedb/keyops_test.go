@@ -0,0 +1,231 @@
+package filedb
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRenameKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		dst    string
+		opts   Options
+		err    error
+		srcval string
+		dstval string
+	}{
+		{"rename", "a", "n", nil, nil, "", "a"},
+		{"nested dst", "a", "x.y", nil, nil, "", "a"},
+		{"existing dst", "a", "b", nil, ErrExist, "a", "b"},
+		{"overwrite dst", "a", "b", Options{"overwrite": true}, nil, "", "a"},
+		{"missing src", "m", "n", nil, ErrNotExist, "", ""},
+		{"same key", "a", "a", nil, nil, "a", "a"},
+	}
+	for _, tt := range tests {
+		dbc, _ := newMemCollection(t, nil)
+		q := dbc.Query()
+		q.Set("a", []byte("a"))
+		q.Set("b", []byte("b"))
+
+		if err := q.RenameKey(tt.src, tt.dst, tt.opts); err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+			continue
+		}
+		if value, _ := q.Get(tt.src); string(value) != tt.srcval {
+			t.Errorf("%s: expected src %q, got %q", tt.name, tt.srcval, value)
+		}
+		if value, _ := q.Get(tt.dst); string(value) != tt.dstval {
+			t.Errorf("%s: expected dst %q, got %q", tt.name, tt.dstval, value)
+		}
+	}
+}
+
+func TestRenameKeyFiles(t *testing.T) {
+	dbc, st := newMemCollection(
+		t, Options{"checksum": true, "backup_generations": 2})
+	q := dbc.Query()
+	for _, v := range []string{"1", "2", "3"} {
+		q.Set("a.k", []byte(v))
+	}
+	q.Set("b.k", []byte("old"))
+	q.Set("b.k", []byte("old2"))
+	q.SetWithTTL("t", []byte("tmp"), time.Hour)
+
+	if err := q.RenameKey("a.k", "b.k", Options{"overwrite": true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/db/a/k", "/db/a/.bak/k", "/db/a/.bak/k.1"} {
+		checkFile(t, st, p, nil)
+	}
+	gens, _ := q.ListGenerations("b.k")
+	if !slices.Equal(gens, []int{1, 2}) {
+		t.Errorf("expected moved generations, got %v", gens)
+	}
+	if value, _ := q.GetGeneration("b.k", 2); string(value) != "1" {
+		t.Errorf("expected moved generation value, got %q", value)
+	}
+
+	// records keep their ttl
+	if err := q.RenameKey("t", "t2", nil); err != nil {
+		t.Fatal(err)
+	}
+	rawdata, _ := st.ReadFile("/db/t2")
+	if _, ok := recordExpiry(rawdata); !ok {
+		t.Error("expected renamed key to keep its expiry")
+	}
+}
+
+func TestMoveKeyAcrossCollections(t *testing.T) {
+	tests := []struct {
+		name    string
+		srcopts Options
+		dstopts Options
+		dstroot string
+	}{
+		{"same format", nil, nil, ""},
+		{"checksum to raw", Options{"checksum": true}, nil, ""},
+		{"raw to checksum", nil, Options{"checksum": true}, ""},
+		{"other storage", nil, nil, "storage"},
+		{"other root", nil, nil, "root"},
+	}
+	for _, tt := range tests {
+		src, st := newMemCollection(t, tt.srcopts)
+		dst := src.Child("dst")
+		dst.UpdateOptions(Options{"checksum": false})
+		dst.UpdateOptions(tt.dstopts)
+		dstst, dstkey := st, "dst.m"
+		switch tt.dstroot {
+		case "storage":
+			dst, dstst = newMemCollection(t, tt.dstopts)
+			dstkey = "m"
+		case "root":
+			dst, _ = NewCollection("/other")
+			dst.InitStorage(st)
+			dstkey = "m"
+		}
+		events := []string{}
+		src.OnDelete(func(key string, oldvalue []byte) {
+			events = append(events, fmt.Sprintf("del %s %s", key, oldvalue))
+		})
+		dst.OnSet(func(key string, oldvalue, newvalue []byte) {
+			events = append(events, fmt.Sprintf("set %s %s", key, newvalue))
+		})
+
+		q := src.Query()
+		q.Set("k", []byte("v"))
+		events = events[:0]
+		if err := q.MoveKey("k", dst, "m", nil); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if q.IsExist("k") {
+			t.Errorf("%s: expected src key removed", tt.name)
+		}
+		if value, err := dst.Query().Get("m"); err != nil || string(value) != "v" {
+			t.Errorf("%s: expected dst value, got %q %v", tt.name, value, err)
+		}
+		checkFile(t, st, "/db/.bak/k", nil)
+		if dstst.nodes[memPath(dst.keyPath("m"))] == nil {
+			t.Errorf("%s: expected dst key file", tt.name)
+		}
+		if !slices.Contains(events, "set "+dstkey+" v") ||
+			!slices.Contains(events, "del k v") {
+			t.Errorf("%s: unexpected hook events %v", tt.name, events)
+		}
+	}
+}
+
+func TestMoveKeyRecover(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		dst   string
+		phase string
+		value []byte
+		path  string
+	}{
+		{"rename", "", "d/m", "", nil, "/db/d/m"},
+		{"converted write", "", "d/m", journalPhaseWrite,
+			encodeRecord([]byte("v"), 0), "/db/d/m"},
+		{"sibling collection", "c", "../s/m", "", nil, "/db/s/m"},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(t, nil)
+		src := dbc
+		if tt.src != "" {
+			src = dbc.Child(tt.src)
+		}
+		q := src.Query()
+		q.Set("k", []byte("v"))
+		srcpath := src.keyPath("k")
+
+		// journal of move interrupted before any key file was moved
+		entry := &journalEntry{Type: journalMoveKey, Src: "k",
+			Dst: tt.dst, Phase: tt.phase, Value: tt.value}
+		st.MkdirAll(src.journalPath(""), 0o775)
+		err := src.writeJournal(q, src.newJournalPath(journalMoveKey), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := src.Recover(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		checkFile(t, st, srcpath, nil)
+		checkFile(t, st, keyBakPath(srcpath), nil)
+		want := []byte("v")
+		if tt.value != nil {
+			want = tt.value
+		}
+		checkFile(t, st, tt.path, want)
+		checkFile(t, st, keyBakPath(tt.path), want)
+	}
+}
+
+func TestMoveKeyJournalPaths(t *testing.T) {
+	dbc, _ := newMemCollection(t, nil)
+	src := dbc.Child("a")
+	tests := []struct {
+		relpath string
+		path    string
+	}{
+		{"k", "/db/a/k"},
+		{"../b/k", "/db/b/k"},
+		{"../../x", ""},
+		{"..", ""},
+	}
+	for _, tt := range tests {
+		path, err := src.relJoin(tt.relpath)
+		if (err == nil) != (tt.path != "") || path != tt.path {
+			t.Errorf("%s: expected path %q, got %q %v",
+				tt.relpath, tt.path, path, err)
+		}
+	}
+	if relpath := src.relPath("/db/b/k"); relpath != "../b/k" {
+		t.Errorf("expected relative dst path, got %q", relpath)
+	}
+}
+
+func TestCopyKeyReencrypt(t *testing.T) {
+	src, _ := newMemCollection(t, nil)
+	src.InitAES128("secret-one")
+	dst := src.Child("c")
+	dst.InitAES256("secret-two")
+
+	q := src.Query()
+	q.SetSecure("k", []byte("plain"))
+	if err := q.CopyKey("k", src.Child("p"), "k", Options{"secure": true}); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{"secure": true}
+	if err := q.CopyKey("k", dst, "k", opts); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := dst.Query().GetSecure("k"); err != nil || string(value) != "plain" {
+		t.Errorf("expected re-encrypted value, got %q %v", value, err)
+	}
+	if value, err := q.GetSecure("k"); err != nil || string(value) != "plain" {
+		t.Errorf("expected source kept, got %q %v", value, err)
+	}
+}
@@ -0,0 +1,128 @@
+package filedb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keys are made of segments separated by "." which map to nested dirs
+// under the collection path. each segment must be 1 to 200 chars of
+// letters, digits, "_" and "-". this guarantees keys never resolve
+// outside the collection path or collide with internal files.
+const maxKeySegment = 200
+
+// check key is valid
+func ValidateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w - empty key", ErrKeyFormat)
+	}
+	for _, seg := range strings.Split(key, keySep) {
+		if seg == "" {
+			return fmt.Errorf("%w - empty key segment: %q", ErrKeyFormat, key)
+		}
+		if len(seg) > maxKeySegment {
+			return fmt.Errorf("%w - key segment too long: %q", ErrKeyFormat, key)
+		}
+		for _, c := range seg {
+			if !isKeyChar(c) {
+				return fmt.Errorf(
+					"%w - invalid char %q in key: %q", ErrKeyFormat, c, key)
+			}
+		}
+	}
+	return nil
+}
+
+func isKeyChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') || c == '_' || c == '-'
+}
+
+// check key is valid for collection
+func (dbc *Collection) checkKey(key string) error {
+	if dbc.keyErr != nil {
+		return dbc.keyErr
+	}
+	if dbc.keyEncoding {
+		if key == "" {
+			return fmt.Errorf("%w - empty key", ErrKeyFormat)
+		}
+		if len(encodeKey(key)) > maxKeySegment {
+			return fmt.Errorf("%w - encoded key too long: %q", ErrKeyFormat, key)
+		}
+		return nil
+	}
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	// keys must not collide with legacy backup files
+	if dbc.legacyBackups && strings.HasSuffix(key, keyBakSuffix) {
+		return fmt.Errorf("%w - reserved backup key: %q", ErrKeyFormat, key)
+	}
+	return nil
+}
+
+// check index key is valid, index names are never encoded
+func (dbc *Collection) checkIndexKey(key string) error {
+	if dbc.keyErr != nil {
+		return dbc.keyErr
+	}
+	return ValidateKey(key)
+}
+
+// with key encoding enabled, keys are arbitrary strings stored as single
+// names where all chars other than letters, digits and "-" are escaped
+// as "%XX". encoded names never contain "." or "_" so they can't collide
+// with internal files or backup files.
+func encodeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || c == '-' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// decode stored key name
+func decodeKey(name string) (string, error) {
+	if !strings.Contains(name, "%") {
+		return name, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("%w - invalid encoded key: %q", ErrKeyFormat, name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("%w - invalid encoded key: %q", ErrKeyFormat, name)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// get key of stored file or dir name, internal names are rejected
+func (dbc *Collection) nameKey(name string) (string, bool) {
+	// names containing key separator are internal files like temp
+	// files and backup generations
+	if strings.HasPrefix(name, ".") || strings.Contains(name, keySep) {
+		return "", false
+	}
+	if !dbc.keyEncoding {
+		return name, true
+	}
+	key, err := decodeKey(name)
+	return key, err == nil
+}
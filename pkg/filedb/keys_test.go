@@ -0,0 +1,128 @@
+package filedb
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// keys resolving outside the collection or onto internal files
+var badKeys = []string{
+	"", "..", "../x", "a..b", "a.", "/etc/passwd", "a/b", `a\b`, "a b",
+	".bak", ".bak.k", ".journal", ".snapshots", ".ix_a", ".ix_a.k", ".lock",
+	strings.Repeat("a", maxKeySegment+1),
+}
+
+func TestValidateKey(t *testing.T) {
+	for _, key := range []string{"a", "a.b", "A_b-1.c2", "k_bak"} {
+		if err := ValidateKey(key); err != nil {
+			t.Errorf("%q: unexpected error %v", key, err)
+		}
+	}
+	for _, key := range badKeys {
+		if err := ValidateKey(key); !errors.Is(err, ErrKeyFormat) {
+			t.Errorf("%q: expected key format error, got %v", key, err)
+		}
+	}
+}
+
+func TestBadKeysRejected(t *testing.T) {
+	dbc, st := newMemCollection(t, nil)
+	q := dbc.Query()
+	for _, key := range badKeys {
+		if err := q.Set(key, []byte("v")); !errors.Is(err, ErrKeyFormat) {
+			t.Errorf("%q: expected key format error on set, got %v", key, err)
+		}
+		if _, err := q.Get(key); !errors.Is(err, ErrKeyFormat) {
+			t.Errorf("%q: expected key format error on get, got %v", key, err)
+		}
+		if _, err := dbc.KeyPathErr(key); key != "" &&
+			!errors.Is(err, ErrKeyFormat) {
+			t.Errorf("%q: expected key format error on path, got %v", key, err)
+		}
+		err := dbc.Child(key).Query().Set("k", []byte("v"))
+		if !errors.Is(err, ErrKeyFormat) {
+			t.Errorf("%q: expected key format error on child, got %v", key, err)
+		}
+		if err := dbc.Index(key).Mark("k"); !errors.Is(err, ErrKeyFormat) {
+			t.Errorf("%q: expected key format error on index, got %v", key, err)
+		}
+	}
+	if len(st.nodes) != 1 {
+		t.Errorf("unexpected files written %d", len(st.nodes)-1)
+	}
+
+	// legacy backup names are reserved in legacy mode
+	dbc.UpdateOptions(Options{"legacy_backups": true})
+	if err := q.Set("k_bak", []byte("v")); !errors.Is(err, ErrKeyFormat) {
+		t.Errorf("expected key format error for legacy backup name, got %v", err)
+	}
+}
+
+func TestEncodedKeysStayInCollection(t *testing.T) {
+	dbc, _ := newMemCollection(t, Options{"key_encoding": true})
+	for _, key := range []string{
+		"..", "../x", "/etc/passwd", "a/b", "a b", ".bak", ".ix_a.k", "k_bak"} {
+		keypath, err := dbc.KeyPathErr(key)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", key, err)
+			continue
+		}
+		name := filepath.Base(keypath)
+		if filepath.Dir(keypath) != "/db" ||
+			strings.HasPrefix(name, ".") || strings.Contains(name, "_") {
+			t.Errorf("%q: unexpected key path %s", key, keypath)
+		}
+	}
+	if err := dbc.Query().Set("", []byte("v")); !errors.Is(err, ErrKeyFormat) {
+		t.Errorf("expected key format error for empty key, got %v", err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	keys := []string{"a", "a.b", "user@example.com", "../x", "k_bak",
+		"with space", "ünïcode", "100%"}
+	for _, key := range keys {
+		name := encodeKey(key)
+		if strings.ContainsAny(name, "._/") {
+			t.Errorf("%q: unexpected chars in encoded name %q", key, name)
+		}
+		if k, err := decodeKey(name); err != nil || k != key {
+			t.Errorf("%q: expected decoded key, got %q %v", key, k, err)
+		}
+	}
+	for _, name := range []string{"%", "%2", "%zz"} {
+		if _, err := decodeKey(name); !errors.Is(err, ErrKeyFormat) {
+			t.Errorf("%q: expected key format error, got %v", name, err)
+		}
+	}
+
+	dbc, st := newMemCollection(t, Options{"key_encoding": true})
+	q := dbc.Query()
+	for _, key := range keys {
+		if err := q.Set(key, []byte(key)); err != nil {
+			t.Fatalf("%q: %v", key, err)
+		}
+	}
+	dbc.Child("c.d").Query().Set("k", []byte("v"))
+	// invalid encoded names are not listed
+	st.WriteFile("/db/bad%zz", []byte("v"), 0o664)
+
+	got, err := q.Keys()
+	want := slices.Clone(keys)
+	slices.Sort(want)
+	slices.Sort(got)
+	if err != nil || !slices.Equal(got, want) {
+		t.Errorf("expected decoded keys %v, got %v %v", want, got, err)
+	}
+	if childs, _ := dbc.ListChilds(); !slices.Equal(childs, []string{"c.d"}) {
+		t.Errorf("expected decoded child, got %v", childs)
+	}
+	for _, key := range keys {
+		if value, err := q.Get(key); err != nil || string(value) != key {
+			t.Errorf("%q: expected value, got %q %v", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package filedb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// collection lock file, operations lock the collections from the
+// collection root down to the dir they work on. parent collections are
+// always locked shared, key operations lock the key dir shared while
+// structural operations like Copy, Move and Purge lock the collection
+// they change exclusively, so they exclude operations on all its nested
+// collections and indexes. the root is the collection created with
+// NewCollection, collections opened separately on nested paths are
+// separate hierarchies not excluded by structural operations of parents.
+const collectionLockFile = ".lock"
+
+// collection lock modes
+const (
+	// shared lock for reads, collections without lock file were never
+	// locked for writing and are not locked so reads never create files
+	lockRead = iota
+	// shared lock for key writes
+	lockShared
+	// exclusive lock for structural operations
+	lockExclusive
+)
+
+// aquire collection locks from collection root down to dirpath using
+// engine timeout and polling options, parents are locked shared and
+// dirpath with mode. returns func to release all locks. collections
+// locked exclusively by the current operation cover all their nested
+// collections and are not locked again.
+func (dbc *Collection) lockChain(
+	dbe *FileEngine, dirpath string, mode int) (func(), error) {
+	dirs := []string{}
+	for p := dirpath; ; p = filepath.Dir(p) {
+		if dbe.locked[filepath.Join(p, collectionLockFile)] {
+			return func() {}, nil
+		}
+		dirs = append(dirs, p)
+		if !strings.HasPrefix(p, dbc.root_path+fileSep) {
+			break
+		}
+	}
+
+	releases := []func(){}
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		m := mode
+		if i > 0 && mode != lockRead {
+			m = lockShared
+		}
+		r, err := dbc.lockDir(dbe, dirs[i], m)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
+
+// aquire lock of collection dir, collections not created yet are not
+// locked since there is nothing to protect.
+func (dbc *Collection) lockDir(
+	dbe *FileEngine, dirpath string, mode int) (func(), error) {
+	finfo, err := dbc.storage.Stat(dirpath)
+	if os.IsNotExist(err) || (finfo != nil && !finfo.IsDir()) {
+		return func() {}, nil
+	}
+	lockpath := filepath.Join(dirpath, collectionLockFile)
+	if mode == lockRead {
+		if _, err := dbc.storage.Stat(lockpath); os.IsNotExist(err) {
+			return func() {}, nil
+		}
+	}
+	return dbe.aquireLock(
+		lockpath, mode == lockExclusive, dbe.OpTimeout, dbe.OpPolling)
+}
+
+// lock collection exclusively for structural operations
+func (dbc *Collection) lockStructure(dbe *FileEngine) (func(), error) {
+	return dbc.lockChain(dbe, dbc.base_path, lockExclusive)
+}
+
+// run fn holding exclusive lock on collection, operations of the query
+// passed to fn don't lock the collection or its nested collections again
+func (dbc *Collection) withTreeLock(
+	dbe *FileEngine, fn func(*Query) error) error {
+	release, err := dbc.lockStructure(dbe)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	e := dbe.withLocked(filepath.Join(dbc.base_path, collectionLockFile))
+	return fn(&Query{FileEngine: e, collection: dbc})
+}
+
+// aquire collection locks for operation on key
+func (dbq *Query) lockKey(key string, mode int) (func(), error) {
+	return dbq.collection.lockChain(dbq.FileEngine,
+		filepath.Dir(dbq.collection.keyPath(key)), mode)
+}
@@ -0,0 +1,55 @@
+package filedb
+
+import (
+	"testing"
+)
+
+func TestReadsCreateNoLockFiles(t *testing.T) {
+	dbc, st := newMemCollection(t, nil)
+	st.MkdirAll("/db/c", 0o775)
+	st.WriteFile("/db/c/k", []byte("v"), 0o664)
+
+	q := dbc.Child("c").Query()
+	if value, err := q.Get("k"); err != nil || string(value) != "v" {
+		t.Fatalf("expected value, got %q %v", value, err)
+	}
+	q.IsExist("k")
+	q.Keys()
+	for _, p := range []string{"/db/.lock", "/db/c/.lock"} {
+		checkFile(t, st, p, nil)
+	}
+}
+
+func TestStructureLockExcludesNestedWrites(t *testing.T) {
+	dbc, _ := newMemCollection(t, nil)
+	dbc.Query().Set("c.d.k", []byte("v"))
+
+	// write of nested key holds the ancestors locks shared
+	q := dbc.Child("c").Query()
+	release, err := q.lockKey("d.k", lockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	tests := []struct {
+		name string
+		dbc  *Collection
+		err  error
+	}{
+		{"root", dbc, ErrTimeout},
+		{"parent", dbc.Child("c"), ErrTimeout},
+		{"sibling", dbc.Child("x"), nil},
+	}
+	for _, tt := range tests {
+		dbq := tt.dbc.Query()
+		dbq.OpTimeout, dbq.OpPolling = 0.2, 0.05
+		r, err := tt.dbc.lockStructure(dbq.FileEngine)
+		if err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+		if err == nil {
+			r()
+		}
+	}
+}
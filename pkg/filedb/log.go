@@ -0,0 +1,69 @@
+package filedb
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// structured log records are emitted for recoveries, failures and
+// structural operations when a logger is set, records carry the key,
+// path, op, error and duration attributes where available.
+
+// set logger for collection, the logger is shared with child
+// collections and queries
+func (dbc *Collection) InitLogger(logger *slog.Logger) {
+	dbc.logger = logger
+}
+
+// set logger for file engine lock events
+func (dbe *FileEngine) InitLogger(logger *slog.Logger) {
+	dbe.logger = logger
+}
+
+// emit log record if logger is set
+func logRecord(ctx context.Context, logger *slog.Logger,
+	level slog.Level, msg string, attrs ...slog.Attr) {
+	if logger == nil {
+		return
+	}
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// log structural operation result, errp points to the operation error
+// to be checked when called deferred
+func (dbc *Collection) logOp(
+	op string, start time.Time, errp *error, attrs ...slog.Attr) {
+	if dbc.logger == nil {
+		return
+	}
+	attrs = append(attrs,
+		slog.String("op", op),
+		slog.String("path", dbc.base_path),
+		slog.Duration("duration", time.Since(start)))
+	if *errp != nil {
+		attrs = append(attrs, slog.String("error", (*errp).Error()))
+		logRecord(dbc.ctx, dbc.logger, slog.LevelError,
+			"filedb operation failed", attrs...)
+		return
+	}
+	logRecord(dbc.ctx, dbc.logger, slog.LevelInfo, "filedb operation", attrs...)
+}
+
+// log key event of query, start is the start time of the key operation
+func (dbq *Query) logKey(level slog.Level, msg, op, key, path string,
+	start time.Time, err error) {
+	if dbq.logger == nil {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("op", op),
+		slog.String("key", key),
+		slog.String("path", path),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	logRecord(dbq.ctx, dbq.logger, level, msg, attrs...)
+}
@@ -0,0 +1,76 @@
+package filedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+// decode json log records
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	res := []map[string]any{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var r map[string]any
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+func TestLogging(t *testing.T) {
+	dbc, st := newMemCollection(t, Options{"checksum": true})
+	var buf bytes.Buffer
+	dbc.InitLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	q := dbc.Query()
+	q.Set("k", []byte("v"))
+	q.Set("c.k", []byte("v"))
+	st.WriteFile("/db/k", []byte("corrupt"), 0o664)
+	q.Get("k")
+	dbc.Rename("missing", "x")
+	dbc.Purge("c")
+	release, _ := st.TryLock("/db", true)
+	q.OpTimeout, q.OpPolling = 0.1, 0.05
+	q.Set("k", []byte("x"))
+	release()
+
+	tests := []struct {
+		level string
+		msg   string
+		attrs map[string]any
+	}{
+		{"WARN", "filedb backup recovery", map[string]any{
+			"op": "read", "key": "k", "path": "/db/.bak/k",
+			"error": ErrCorrupt.Error()}},
+		{"ERROR", "filedb operation failed", map[string]any{
+			"op": "rename", "src": "missing", "dst": "x", "path": "/db",
+			"error": "src collection does not exist"}},
+		{"INFO", "filedb operation", map[string]any{
+			"op": "purge", "key": "c", "path": "/db"}},
+		{"WARN", "filedb lock timeout", map[string]any{
+			"op": "lock", "path": "/db", "error": ErrTimeout.Error()}},
+	}
+	records := logRecords(t, &buf)
+	if len(records) != len(tests) {
+		t.Fatalf("expected %d records, got %v", len(tests), records)
+	}
+	for i, tt := range tests {
+		r := records[i]
+		if r["level"] != tt.level || r["msg"] != tt.msg {
+			t.Errorf("%s: unexpected record %v", tt.msg, r)
+			continue
+		}
+		for k, v := range tt.attrs {
+			if r[k] != v {
+				t.Errorf("%s: expected %s=%v, got %v", tt.msg, k, v, r[k])
+			}
+		}
+		if _, ok := r["duration"]; !ok && tt.attrs["op"] != "lock" {
+			t.Errorf("%s: expected duration attribute", tt.msg)
+		}
+	}
+}
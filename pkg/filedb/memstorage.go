@@ -0,0 +1,352 @@
+package filedb
+
+import (
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemStorage is a pure in-memory storage backend, mainly for testing
+// without touching disk. relative paths are resolved against the root.
+type MemStorage struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+	locks map[string]*memLock
+}
+
+type memNode struct {
+	dir   bool
+	data  []byte
+	perm  fs.FileMode
+	mtime time.Time
+}
+
+type memLock struct {
+	shared    int
+	exclusive bool
+}
+
+// create new empty in-memory storage
+func NewMemStorage() *MemStorage {
+	return &MemStorage{
+		nodes: map[string]*memNode{
+			fileSep: {dir: true, perm: fs.ModePerm, mtime: time.Now()},
+		},
+		locks: map[string]*memLock{},
+	}
+}
+
+func (st *MemStorage) Stat(path string) (fs.FileInfo, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	n, ok := st.nodes[path]
+	if !ok {
+		return nil, memError("stat", path, fs.ErrNotExist)
+	}
+	return &memFileInfo{name: filepath.Base(path), node: n}, nil
+}
+
+func (st *MemStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	n, ok := st.nodes[path]
+	if !ok {
+		return nil, memError("readdir", path, fs.ErrNotExist)
+	} else if !n.dir {
+		return nil, memError("readdir", path, syscall.ENOTDIR)
+	}
+
+	res := []fs.DirEntry{}
+	for p, c := range st.nodes {
+		if p != path && filepath.Dir(p) == path {
+			res = append(res, fs.FileInfoToDirEntry(
+				&memFileInfo{name: filepath.Base(p), node: c}))
+		}
+	}
+	slices.SortFunc(res, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return res, nil
+}
+
+func (st *MemStorage) MkdirAll(path string, perm fs.FileMode) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	if n, ok := st.nodes[path]; ok {
+		if !n.dir {
+			return memError("mkdir", path, syscall.ENOTDIR)
+		}
+		return nil
+	}
+	if err := st.checkParent("mkdir", path, true, perm); err != nil {
+		return err
+	}
+	st.nodes[path] = &memNode{dir: true, perm: perm, mtime: time.Now()}
+	return nil
+}
+
+func (st *MemStorage) ReadFile(path string) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	n, ok := st.nodes[path]
+	if !ok {
+		return nil, memError("open", path, fs.ErrNotExist)
+	} else if n.dir {
+		return nil, memError("read", path, syscall.EISDIR)
+	}
+	return slices.Clone(n.data), nil
+}
+
+// read up to n bytes from start of file, implements HeadReader
+func (st *MemStorage) ReadHead(path string, n int) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	node, ok := st.nodes[path]
+	if !ok {
+		return nil, memError("open", path, fs.ErrNotExist)
+	} else if node.dir {
+		return nil, memError("read", path, syscall.EISDIR)
+	}
+	return slices.Clone(node.data[:min(n, len(node.data))]), nil
+}
+
+func (st *MemStorage) WriteFile(
+	path string, data []byte, perm fs.FileMode) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	if n, ok := st.nodes[path]; ok && n.dir {
+		return memError("open", path, syscall.EISDIR)
+	}
+	if err := st.checkParent("open", path, false, 0); err != nil {
+		return err
+	}
+	st.nodes[path] = &memNode{
+		data: slices.Clone(data), perm: perm, mtime: time.Now()}
+	return nil
+}
+
+func (st *MemStorage) TouchFile(path string, perm fs.FileMode) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	if n, ok := st.nodes[path]; ok {
+		if n.dir {
+			return memError("open", path, syscall.EISDIR)
+		}
+		return nil
+	}
+	if err := st.checkParent("open", path, false, 0); err != nil {
+		return err
+	}
+	st.nodes[path] = &memNode{data: []byte{}, perm: perm, mtime: time.Now()}
+	return nil
+}
+
+func (st *MemStorage) Remove(path string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	n, ok := st.nodes[path]
+	if !ok {
+		return memError("remove", path, fs.ErrNotExist)
+	}
+	if n.dir && st.hasChilds(path) {
+		return memError("remove", path, syscall.ENOTEMPTY)
+	}
+	delete(st.nodes, path)
+	return nil
+}
+
+func (st *MemStorage) RemoveAll(path string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	if path == fileSep {
+		return memError("removeall", path, syscall.EINVAL)
+	}
+	for p := range st.nodes {
+		if p == path || memIsUnder(p, path) {
+			delete(st.nodes, p)
+		}
+	}
+	return nil
+}
+
+func (st *MemStorage) Rename(oldpath, newpath string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	oldpath, newpath = memPath(oldpath), memPath(newpath)
+	src, ok := st.nodes[oldpath]
+	if !ok {
+		return memError("rename", oldpath, fs.ErrNotExist)
+	}
+	if oldpath == newpath {
+		return nil
+	}
+	if memIsUnder(newpath, oldpath) {
+		return memError("rename", newpath, syscall.EINVAL)
+	}
+	if err := st.checkParent("rename", newpath, false, 0); err != nil {
+		return err
+	}
+	if dst, ok := st.nodes[newpath]; ok {
+		if src.dir != dst.dir {
+			if dst.dir {
+				return memError("rename", newpath, syscall.EISDIR)
+			}
+			return memError("rename", newpath, syscall.ENOTDIR)
+		}
+		if dst.dir && st.hasChilds(newpath) {
+			return memError("rename", newpath, syscall.ENOTEMPTY)
+		}
+	}
+
+	moved := map[string]*memNode{}
+	for p, n := range st.nodes {
+		if memIsUnder(p, oldpath) {
+			moved[newpath+strings.TrimPrefix(p, oldpath)] = n
+			delete(st.nodes, p)
+		}
+	}
+	for p, n := range moved {
+		st.nodes[p] = n
+	}
+	delete(st.nodes, oldpath)
+	st.nodes[newpath] = src
+	return nil
+}
+
+// lock path in memory, non existing path is created as empty lock file
+// like the filesystem storage. locks are kept apart from the nodes.
+func (st *MemStorage) TryLock(path string, exclusive bool) (func(), error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = memPath(path)
+	if _, ok := st.nodes[path]; !ok {
+		if err := st.checkParent("open", path, false, 0); err != nil {
+			return nil, err
+		}
+		st.nodes[path] = &memNode{
+			data: []byte{}, perm: fs.FileMode(defaultFilePerm),
+			mtime: time.Now()}
+	}
+	l, ok := st.locks[path]
+	if !ok {
+		l = &memLock{}
+		st.locks[path] = l
+	}
+	if l.exclusive || (exclusive && l.shared > 0) {
+		return nil, ErrLocked
+	}
+	if exclusive {
+		l.exclusive = true
+	} else {
+		l.shared++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			if exclusive {
+				l.exclusive = false
+			} else {
+				l.shared--
+			}
+			if !l.exclusive && l.shared == 0 {
+				delete(st.locks, path)
+			}
+		})
+	}, nil
+}
+
+// check parent dir of path exists, optionally creating missing parents
+func (st *MemStorage) checkParent(
+	op, path string, create bool, perm fs.FileMode) error {
+	parent := filepath.Dir(path)
+	if n, ok := st.nodes[parent]; ok {
+		if !n.dir {
+			return memError(op, path, syscall.ENOTDIR)
+		}
+		return nil
+	}
+	if !create {
+		return memError(op, path, fs.ErrNotExist)
+	}
+	if err := st.checkParent(op, parent, true, perm); err != nil {
+		return err
+	}
+	st.nodes[parent] = &memNode{dir: true, perm: perm, mtime: time.Now()}
+	return nil
+}
+
+// check if dir has child entries
+func (st *MemStorage) hasChilds(path string) bool {
+	for p := range st.nodes {
+		if memIsUnder(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+type memFileInfo struct {
+	name string
+	node *memNode
+}
+
+func (fi *memFileInfo) Name() string { return fi.name }
+
+func (fi *memFileInfo) Size() int64 { return int64(len(fi.node.data)) }
+
+func (fi *memFileInfo) Mode() fs.FileMode {
+	if fi.node.dir {
+		return fs.ModeDir | fi.node.perm
+	}
+	return fi.node.perm
+}
+
+func (fi *memFileInfo) ModTime() time.Time { return fi.node.mtime }
+
+func (fi *memFileInfo) IsDir() bool { return fi.node.dir }
+
+func (fi *memFileInfo) Sys() any { return nil }
+
+// convert path to cleaned absolute path
+func memPath(path string) string {
+	return filepath.Join(fileSep, path)
+}
+
+// check if path is a descendant of dir path
+func memIsUnder(path, dirpath string) bool {
+	if dirpath == fileSep {
+		return path != fileSep
+	}
+	return strings.HasPrefix(path, dirpath+fileSep)
+}
+
+func memError(op, path string, err error) error {
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
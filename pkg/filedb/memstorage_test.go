@@ -0,0 +1,84 @@
+package filedb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemStorage(t *testing.T) {
+	st := NewMemStorage()
+	if err := st.MkdirAll("/a/b", 0o775); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		op   func() error
+		err  bool
+	}{
+		{"write", func() error {
+			return st.WriteFile("/a/b/k", []byte("v"), 0o664)
+		}, false},
+		{"write missing dir", func() error {
+			return st.WriteFile("/x/k", []byte("v"), 0o664)
+		}, true},
+		{"touch", func() error { return st.TouchFile("/a/t", 0o664) }, false},
+		{"rename", func() error { return st.Rename("/a/t", "/a/b/t") }, false},
+		{"remove non empty dir", func() error { return st.Remove("/a/b") }, true},
+		{"remove file", func() error { return st.Remove("/a/b/t") }, false},
+		{"remove missing", func() error { return st.Remove("/a/b/t") }, true},
+	}
+	for _, tt := range tests {
+		if err := tt.op(); (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+	checkFile(t, st, "/a/b/k", []byte("v"))
+
+	head, err := st.ReadHead("/a/b/k", 10)
+	if err != nil || string(head) != "v" {
+		t.Errorf("read head: got %q %v", head, err)
+	}
+
+	release, err := st.TryLock("/a/.lock", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.TryLock("/a/.lock", false); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected locked error, got %v", err)
+	}
+	release()
+	release, err = st.TryLock("/a/.lock", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestCollectionOnMemStorage(t *testing.T) {
+	dbc, st := newMemCollection(t, nil)
+	q := dbc.Query()
+	for _, k := range []string{"a", "b", "c.d"} {
+		if err := q.Set(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := q.Keys()
+	if err != nil || len(keys) != 2 {
+		t.Errorf("keys: got %v %v", keys, err)
+	}
+	childs, err := dbc.ListChilds()
+	if err != nil || len(childs) != 1 || childs[0] != "c" {
+		t.Errorf("childs: got %v %v", childs, err)
+	}
+	checkFile(t, st, "/db/c/d", []byte("c.d"))
+	checkFile(t, st, "/db/c/.bak/d", []byte("c.d"))
+
+	if err := q.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, st, "/db/a", nil)
+	checkFile(t, st, "/db/.bak/a", nil)
+	if _, err := q.Get("a"); err != ErrNotExist {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
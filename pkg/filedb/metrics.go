@@ -0,0 +1,211 @@
+package filedb
+
+import (
+	"errors"
+	"expvar"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// metrics operation types
+const (
+	MetricRead   = "read"
+	MetricWrite  = "write"
+	MetricDelete = "delete"
+	MetricLock   = "lock"
+)
+
+// metrics event counters
+const (
+	// values recovered from backup files on read
+	MetricBackupRecoveries = "backup_recoveries"
+	// values failing to decrypt
+	MetricDecryptFailures = "decrypt_failures"
+	// lock waits exceeding the operation timeout
+	MetricTimeouts = "timeouts"
+	// locks held by others without waiting
+	MetricLocked = "locked"
+	// locks acquired after waiting for others
+	MetricLockWaits = "lock_waits"
+	// unfinished journal entries processed by Recover
+	MetricJournalRecoveries = "journal_recoveries"
+)
+
+// upper bounds of latency histogram buckets, the last bucket counts
+// all larger values
+var metricsLatencyBounds = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Metrics collects operation counts, bytes and latencies of collections
+// and file engines sharing it. a nil Metrics collects nothing.
+type Metrics struct {
+	mu       sync.Mutex
+	ops      map[string]*OpStats
+	counters map[string]uint64
+}
+
+// OpStats holds the collected stats of an operation type
+type OpStats struct {
+	// number of operations
+	Count uint64 `json:"count"`
+	// number of failed operations, not existing keys are not failures
+	Errors uint64 `json:"errors"`
+	// number of operations on not existing keys
+	Misses uint64 `json:"misses"`
+	// number of bytes read or written
+	Bytes uint64 `json:"bytes"`
+	// operations latency
+	Latency Histogram `json:"latency"`
+}
+
+// Histogram holds latency counts per bucket, Counts has one more item
+// than Bounds for values larger than the last bound
+type Histogram struct {
+	Bounds []time.Duration `json:"bounds"`
+	Counts []uint64        `json:"counts"`
+	Sum    time.Duration   `json:"sum"`
+}
+
+// Stats is a snapshot of collected metrics
+type Stats struct {
+	Ops      map[string]OpStats `json:"ops"`
+	Counters map[string]uint64  `json:"counters"`
+}
+
+// create new metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ops:      map[string]*OpStats{},
+		counters: map[string]uint64{},
+	}
+}
+
+// get snapshot of collected metrics
+func (m *Metrics) Stats() Stats {
+	if m == nil {
+		return Stats{Ops: map[string]OpStats{}, Counters: map[string]uint64{}}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ops := map[string]OpStats{}
+	for op, s := range m.ops {
+		c := *s
+		c.Latency.Bounds = slices.Clone(s.Latency.Bounds)
+		c.Latency.Counts = slices.Clone(s.Latency.Counts)
+		ops[op] = c
+	}
+	return Stats{Ops: ops, Counters: maps.Clone(m.counters)}
+}
+
+// reset collected metrics
+func (m *Metrics) Reset() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ops = map[string]*OpStats{}
+	m.counters = map[string]uint64{}
+}
+
+// publish metrics stats snapshot through expvar with name, expvar panics
+// if the name is already published
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any { return m.Stats() }))
+}
+
+// record operation started at start with bytes count and result,
+// operations failing with ErrNotExist are counted as misses
+func (m *Metrics) observe(op string, start time.Time, n int, err error) {
+	m.record(op, start, n, errors.Is(err, ErrNotExist), err)
+}
+
+// record operation started at start on not existing key
+func (m *Metrics) observeMiss(op string, start time.Time) {
+	m.record(op, start, 0, true, nil)
+}
+
+// record operation stats, misses are not counted as errors
+func (m *Metrics) record(
+	op string, start time.Time, n int, miss bool, err error) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.ops[op]
+	if !ok {
+		s = &OpStats{Latency: Histogram{
+			Bounds: metricsLatencyBounds,
+			Counts: make([]uint64, len(metricsLatencyBounds)+1),
+		}}
+		m.ops[op] = s
+	}
+	s.Count++
+	if miss {
+		s.Misses++
+	} else if err != nil {
+		s.Errors++
+	}
+	s.Bytes += uint64(n)
+	i, _ := slices.BinarySearch(s.Latency.Bounds, d)
+	s.Latency.Counts[i]++
+	s.Latency.Sum += d
+}
+
+// increment event counter
+func (m *Metrics) inc(counter string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[counter]++
+}
+
+// record lock aquire result
+func (m *Metrics) observeLock(start time.Time, waited bool, err error) {
+	if m == nil {
+		return
+	}
+	m.observe(MetricLock, start, 0, err)
+	switch {
+	case errors.Is(err, ErrTimeout):
+		m.inc(MetricTimeouts)
+	case err == ErrLocked:
+		m.inc(MetricLocked)
+	case err == nil && waited:
+		m.inc(MetricLockWaits)
+	}
+}
+
+// set metrics collector for collection, metrics are shared with child
+// collections and queries
+func (dbc *Collection) InitMetrics(m *Metrics) {
+	dbc.metrics = m
+}
+
+// get snapshot of collection metrics
+func (dbc *Collection) Stats() Stats {
+	return dbc.metrics.Stats()
+}
+
+// set metrics collector for file engine lock waits
+func (dbe *FileEngine) InitMetrics(m *Metrics) {
+	dbe.metrics = m
+}
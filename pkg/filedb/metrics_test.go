@@ -0,0 +1,61 @@
+package filedb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	dbc, st := newMemCollection(t, nil)
+	dbc.InitMetrics(NewMetrics())
+	q := dbc.Query()
+	q.Set("a", []byte("v"))
+	q.Get("a")
+	q.Get("missing")
+	q.Delete("a")
+	q.Delete("a")
+	release, _ := st.TryLock("/db", true)
+	q.OpTimeout = 0
+	q.Set("b", []byte("v"))
+	release()
+
+	tests := []struct {
+		op     string
+		count  uint64
+		errors uint64
+		misses uint64
+		bytes  uint64
+	}{
+		{MetricRead, 2, 0, 1, 1},
+		{MetricWrite, 2, 1, 0, 2},
+		{MetricDelete, 2, 0, 1, 0},
+	}
+	stats := dbc.Stats()
+	for _, tt := range tests {
+		s := stats.Ops[tt.op]
+		if s.Count != tt.count || s.Errors != tt.errors ||
+			s.Misses != tt.misses || s.Bytes != tt.bytes {
+			t.Errorf("%s: unexpected stats %+v", tt.op, s)
+		}
+	}
+	if stats.Counters[MetricLocked] != 1 {
+		t.Errorf("expected locked counter, got %v", stats.Counters)
+	}
+
+	// snapshot is not shared with collector
+	stats.Ops[MetricRead].Latency.Bounds[0] = time.Hour
+	stats.Ops[MetricRead].Latency.Counts[0] = 100
+	if metricsLatencyBounds[0] == time.Hour ||
+		dbc.Stats().Ops[MetricRead].Latency.Counts[0] == 100 {
+		t.Error("expected stats snapshot copy")
+	}
+
+	dbc.metrics.Reset()
+	if ops := dbc.Stats().Ops; len(ops) != 0 {
+		t.Errorf("expected reset stats, got %v", ops)
+	}
+	var m *Metrics
+	if s := m.Stats(); s.Ops == nil || s.Counters == nil {
+		t.Error("expected empty stats of nil metrics")
+	}
+}
@@ -1,12 +1,14 @@
 package filedb
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/fs"
-	"os"
+	"log/slog"
 	"path/filepath"
-	"strings"
+	"slices"
+	"time"
 
 	"github.com/exonlabs/go-utils/pkg/types"
 )
@@ -17,158 +19,104 @@ type Query struct {
 }
 
 func newQuery(dbc *Collection) *Query {
+	dbe := NewFileEngineWithStorage(dbc.storage)
+	dbe.ctx = dbc.ctx
+	dbe.metrics = dbc.metrics
+	dbe.logger = dbc.logger
 	return &Query{
-		FileEngine: NewFileEngine(),
+		FileEngine: dbe,
 		collection: dbc,
 	}
 }
 
+// create copy of query bound to context, lock waits and scans are
+// aborted when context is done
+func (dbq *Query) WithContext(ctx context.Context) *Query {
+	return &Query{
+		FileEngine: dbq.FileEngine.WithContext(ctx),
+		collection: dbq.collection,
+	}
+}
+
+// list keys of collection, expired keys are not listed
 func (dbq *Query) Keys() ([]string, error) {
-	res := []string{}
-	err := filepath.Walk(dbq.collection.base_path,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				if !strings.HasSuffix(path, keyBakSuffix) {
-					res = append(res, strings.TrimPrefix(
-						path, dbq.collection.base_path+fileSep))
-				}
-			} else if path != dbq.collection.base_path {
-				return fs.SkipDir
-			}
-			return nil
-		},
-	)
+	keys, err := dbq.keys()
 	if err != nil {
 		return nil, err
 	}
+	return slices.DeleteFunc(keys, func(key string) bool {
+		return dbq.isExpired(dbq.collection.keyPath(key))
+	}), nil
+}
+
+// list all stored keys of collection including expired keys
+func (dbq *Query) keys() ([]string, error) {
+	if dbq.collection.keyErr != nil {
+		return nil, dbq.collection.keyErr
+	}
+	if dbq.ctx.Err() != nil {
+		return nil, ctxError(dbq.ctx)
+	}
+	entries, err := dbq.storage.ReadDir(dbq.collection.base_path)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, e := range entries {
+		n := e.Name()
+		if !e.Type().IsRegular() || dbq.collection.isLegacyBak(n) {
+			continue
+		}
+		if key, ok := dbq.collection.nameKey(n); ok {
+			res = append(res, key)
+		}
+	}
 	return res, nil
 }
 
 func (dbq *Query) IsExist(key string) bool {
-	return dbq.FileExist(dbq.collection.KeyPath(key))
+	if dbq.collection.checkKey(key) != nil {
+		return false
+	}
+	keypath := dbq.collection.keyPath(key)
+	return dbq.FileExist(keypath) && !dbq.isExpired(keypath)
 }
 
 func (dbq *Query) Get(key string) ([]byte, error) {
-	keypath := dbq.collection.KeyPath(key)
-	keybakpath := dbq.collection.KeyPath(key + keyBakSuffix)
-
-	err := ErrNotExist
-
-	// check main file
-	if dbq.FileExist(keypath) {
-		var data []byte
-		data, err = dbq.ReadFile(keypath)
-		if err == nil {
-			dbq.WriteFile(keybakpath, data)
-			return data, nil
-		}
-	}
-
-	// check backup
-	if dbq.FileExist(keybakpath) {
-		var data []byte
-		data, err = dbq.ReadFile(keybakpath)
-		if err == nil {
-			dbq.WriteFile(keypath, data)
-			return data, nil
-		}
+	var data []byte
+	err := dbq.read(key, func(b []byte) error {
+		data = b
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, err
+	return data, nil
 }
 func (dbq *Query) GetBuffer(key string) (Buffer, error) {
-	keypath := dbq.collection.KeyPath(key)
-	keybakpath := dbq.collection.KeyPath(key + keyBakSuffix)
-
-	err := ErrNotExist
-
-	// check main file
-	if dbq.FileExist(keypath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keypath)
-		if err == nil {
-			var data map[string]any
-			err = json.Unmarshal(rawdata, &data)
-			if err == nil {
-				dbq.WriteFile(keybakpath, rawdata)
-				return types.NewNDict(data), nil
-			}
-		}
-	}
-
-	// check backup
-	if dbq.FileExist(keybakpath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keybakpath)
-		if err == nil {
-			var data map[string]any
-			err = json.Unmarshal(rawdata, &data)
-			if err == nil {
-				dbq.WriteFile(keypath, rawdata)
-				return types.NewNDict(data), nil
-			}
-		}
+	var data map[string]any
+	err := dbq.read(key, func(b []byte) error {
+		data = nil
+		return json.Unmarshal(b, &data)
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, err
+	return types.NewNDict(data), nil
 }
 func (dbq *Query) GetBufferSlice(key string) ([]Buffer, error) {
-	keypath := dbq.collection.KeyPath(key)
-	keybakpath := dbq.collection.KeyPath(key + keyBakSuffix)
-
-	err := ErrNotExist
-
-	// check main file
-	if dbq.FileExist(keypath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keypath)
-		if err == nil {
-			var data []map[string]any
-			err = json.Unmarshal(rawdata, &data)
-			if err == nil {
-				dbq.WriteFile(keybakpath, rawdata)
-				var res []Buffer
-				for _, d := range data {
-					res = append(res, types.NewNDict(d))
-				}
-				return res, nil
-			}
-		}
-	}
-
-	// check backup
-	if dbq.FileExist(keybakpath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keybakpath)
-		if err == nil {
-			var data []map[string]any
-			err = json.Unmarshal(rawdata, &data)
-			if err == nil {
-				dbq.WriteFile(keypath, rawdata)
-				var res []Buffer
-				for _, d := range data {
-					res = append(res, types.NewNDict(d))
-				}
-				return res, nil
-			}
-		}
+	var data []map[string]any
+	err := dbq.read(key, func(b []byte) error {
+		return json.Unmarshal(b, &data)
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, err
+	return toBufferSlice(data), nil
 }
 
 func (dbq *Query) Set(key string, value []byte) error {
-	keypath := dbq.collection.KeyPath(key)
-	keybakpath := dbq.collection.KeyPath(key + keyBakSuffix)
-
-	err := dbq.WriteFile(keypath, value)
-	if err != nil {
-		return err
-	}
-	return dbq.WriteFile(keybakpath, value)
+	return dbq.write(key, dbq.collection.encodeValue(value))
 }
 func (dbq *Query) SetBuffer(key string, value Buffer) error {
 	data, err := json.MarshalIndent(value, "", "  ")
@@ -187,185 +135,356 @@ func (dbq *Query) SetBufferSlice(key string, value []Buffer) error {
 
 // delete file
 func (dbq *Query) Delete(key string) error {
-	keypath := dbq.collection.KeyPath(key)
-	keybakpath := dbq.collection.KeyPath(key + keyBakSuffix)
-	if dbq.FileExist(keybakpath) {
-		dbq.PurgeFile(keybakpath)
+	start := time.Now()
+	existed, oldvalue, err := dbq.delete(key)
+	if err == nil && !existed {
+		dbq.metrics.observeMiss(MetricDelete, start)
+	} else {
+		dbq.metrics.observe(MetricDelete, start, 0, err)
 	}
-	if dbq.FileExist(keypath) {
-		return dbq.PurgeFile(keypath)
+	if err != nil {
+		return err
+	}
+	if existed {
+		dbq.collection.fireDelete(key, oldvalue)
 	}
 	return nil
 }
 
-// read file content with shared locking
+// delete key files, returns if key existed with its value if needed
+// by delete hooks. files are removed holding the key dir lock so the
+// delete is serialized with concurrent writes of the key.
+func (dbq *Query) delete(key string) (existed bool, oldvalue []byte, err error) {
+	err = dbq.withKeyLock(key, func(q *Query) error {
+		keypath := q.collection.keyPath(key)
+		if q.collection.hasDeleteHooks() {
+			oldvalue = q.hookValue(keypath)
+		}
+		if err := q.purgeBackups(keypath); err != nil {
+			return err
+		}
+		if !q.FileExist(keypath) {
+			return nil
+		}
+		existed = true
+		return q.PurgeFile(keypath)
+	})
+	if err != nil || !existed {
+		return false, nil, err
+	}
+	return true, oldvalue, nil
+}
+
 func (dbq *Query) GetSecure(key string) ([]byte, error) {
 	if dbq.collection.cipher == nil {
 		return nil, ErrNoSecurity
 	}
 
-	keypath := dbq.collection.KeyPath(key)
-	keybakpath := dbq.collection.KeyPath(key + keyBakSuffix)
-
-	err := ErrNotExist
+	var data []byte
+	err := dbq.read(key, func(b []byte) error {
+		var err error
+		data, err = dbq.decrypt(key, b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+func (dbq *Query) GetSecureBuffer(key string) (Buffer, error) {
+	if dbq.collection.cipher == nil {
+		return nil, ErrNoSecurity
+	}
 
-	// check main file
-	if dbq.FileExist(keypath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keypath)
-		if err == nil {
-			var value []byte
-			value, err = dbq.collection.cipher.Decrypt(rawdata)
-			if err == nil {
-				dbq.WriteFile(keybakpath, rawdata)
-				return value, nil
-			}
+	var data map[string]any
+	err := dbq.read(key, func(b []byte) error {
+		value, err := dbq.decrypt(key, b)
+		if err != nil {
+			return err
 		}
+		data = nil
+		return json.Unmarshal(value, &data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return types.NewNDict(data), nil
+}
+func (dbq *Query) GetSecureBufferSlice(key string) ([]Buffer, error) {
+	if dbq.collection.cipher == nil {
+		return nil, ErrNoSecurity
 	}
 
-	// check backup
-	if dbq.FileExist(keybakpath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keybakpath)
-		if err == nil {
-			var value []byte
-			value, err = dbq.collection.cipher.Decrypt(rawdata)
-			if err == nil {
-				dbq.WriteFile(keypath, rawdata)
-				return value, nil
-			}
+	var data []map[string]any
+	err := dbq.read(key, func(b []byte) error {
+		value, err := dbq.decrypt(key, b)
+		if err != nil {
+			return err
 		}
+		return json.Unmarshal(value, &data)
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, err
+	return toBufferSlice(data), nil
 }
-func (dbq *Query) GetSecureBuffer(key string) (Buffer, error) {
+
+// encrypt and write content to file
+func (dbq *Query) SetSecure(key string, value []byte) error {
 	if dbq.collection.cipher == nil {
-		return nil, ErrNoSecurity
+		return ErrNoSecurity
 	}
+	b, err := dbq.collection.cipher.Encrypt(value)
+	if err != nil {
+		return fmt.Errorf("%w%s", ErrEncrypt, err.Error())
+	}
+	return dbq.Set(key, b)
+}
+func (dbq *Query) SetSecureBuffer(key string, value Buffer) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+	return dbq.SetSecure(key, data)
+}
+func (dbq *Query) SetSecureBufferSlice(key string, value []Buffer) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+	return dbq.SetSecure(key, data)
+}
 
-	keypath := dbq.collection.KeyPath(key)
-	keybakpath := dbq.collection.KeyPath(key + keyBakSuffix)
+// write raw record content to key and fire set hooks
+func (dbq *Query) write(key string, rawdata []byte) error {
+	start := time.Now()
+	oldvalue, err := dbq.writeKey(key, rawdata)
+	dbq.metrics.observe(MetricWrite, start, len(rawdata), err)
+	if err != nil {
+		return err
+	}
+	if dbc := dbq.collection; dbc.hasSetHooks() {
+		newvalue, _, _ := dbc.decodeValue(rawdata)
+		dbc.fireSet(key, oldvalue, newvalue)
+	}
+	return nil
+}
 
-	err := ErrNotExist
+// write raw record content to key main and backup files, the previous
+// content is rotated into backup generations if enabled. returns the
+// previous value if needed by set hooks.
+func (dbq *Query) writeKey(
+	key string, rawdata []byte) (oldvalue []byte, err error) {
+	if err = dbq.collection.checkKey(key); err != nil {
+		return nil, err
+	}
+	keypath := dbq.collection.keyPath(key)
+	keybakpath := dbq.bakPath(key)
 
-	// check main file
-	if dbq.FileExist(keypath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keypath)
-		if err == nil {
-			var value []byte
-			value, err = dbq.collection.cipher.Decrypt(rawdata)
+	release, err := dbq.lockKey(key, lockShared)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// log write intent, on failure the journal is kept for Recover
+	if dbq.collection.journal {
+		dbc := dbq.collection
+		jpath := dbc.newJournalPath(journalSet)
+		err = dbc.writeJournal(
+			dbq, jpath, &journalEntry{Type: journalSet, Key: key})
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
 			if err == nil {
-				var data map[string]any
-				err = json.Unmarshal(value, &data)
-				if err == nil {
-					dbq.WriteFile(keybakpath, rawdata)
-					return types.NewNDict(data), nil
-				}
+				err = dbq.PurgeFile(jpath)
 			}
-		}
+		}()
 	}
 
-	// check backup
-	if dbq.FileExist(keybakpath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keybakpath)
-		if err == nil {
-			var value []byte
-			value, err = dbq.collection.cipher.Decrypt(rawdata)
-			if err == nil {
-				var data map[string]any
-				err = json.Unmarshal(value, &data)
-				if err == nil {
-					dbq.WriteFile(keypath, rawdata)
-					return types.NewNDict(data), nil
-				}
+	// generations are rotated holding the key dir lock with the main
+	// file write, so concurrent writes of the key are serialized
+	err = dbq.WithDirLock(filepath.Dir(keypath), func(dbe *FileEngine) error {
+		q := &Query{FileEngine: dbe, collection: dbq.collection}
+		if q.collection.hasSetHooks() {
+			oldvalue = q.hookValue(keypath)
+		}
+		if q.collection.backupGenerations > 0 && q.FileExist(keypath) {
+			if err := q.rotateGenerations(key, keypath); err != nil {
+				return err
+			}
+		}
+
+		if err := q.WriteFile(keypath, rawdata); err != nil {
+			return err
+		}
+		if q.collection.backupPolicy != BackupDisabled {
+			if err := q.WriteFile(keybakpath, rawdata); err != nil {
+				return err
+			}
+		} else if q.FileExist(keybakpath) {
+			// remove stale backup to avoid falling back to old content
+			if err := q.PurgeFile(keybakpath); err != nil {
+				return err
 			}
 		}
+		return q.purgeLegacyBackup(keypath)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return oldvalue, nil
+}
 
-	return nil, err
+// read key value from main file falling back to backup file. the record
+// is decoded and its payload passed to parse, a main file failing to read,
+// verify or parse is treated as corrupted and repaired from the backup.
+// the backup itself is only checked on reads with BackupVerify policy.
+func (dbq *Query) read(key string, parse func([]byte) error) error {
+	_, err := dbq.readKey(key, parse)
+	return err
 }
-func (dbq *Query) GetSecureBufferSlice(key string) ([]Buffer, error) {
-	if dbq.collection.cipher == nil {
-		return nil, ErrNoSecurity
+
+// read key value like read, returns the raw record content
+func (dbq *Query) readKey(
+	key string, parse func([]byte) error) (rawdata []byte, err error) {
+	start := time.Now()
+	defer func() { dbq.metrics.observe(MetricRead, start, len(rawdata), err) }()
+
+	if err := dbq.collection.checkKey(key); err != nil {
+		return nil, err
 	}
+	keypath := dbq.collection.keyPath(key)
+	keybakpath := dbq.bakPath(key)
 
-	keypath := dbq.collection.KeyPath(key)
-	keybakpath := dbq.collection.KeyPath(key + keyBakSuffix)
+	release, err := dbq.lockKey(key, lockRead)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-	err := ErrNotExist
+	err = ErrNotExist
 
 	// check main file
+	var mainErr error
 	if dbq.FileExist(keypath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keypath)
+		rawdata, err = dbq.readRecord(keypath, parse)
 		if err == nil {
-			var value []byte
-			value, err = dbq.collection.cipher.Decrypt(rawdata)
-			if err == nil {
-				var data []map[string]any
-				err = json.Unmarshal(value, &data)
-				if err == nil {
-					dbq.WriteFile(keybakpath, rawdata)
-					var res []Buffer
-					for _, d := range data {
-						res = append(res, types.NewNDict(d))
-					}
-					return res, nil
-				}
+			if dbq.collection.backupPolicy == BackupVerify {
+				dbq.verifyBackup(key, keybakpath, rawdata, start)
 			}
+			return rawdata, nil
 		}
+		mainErr = err
 	}
 
-	// check backup
-	if dbq.FileExist(keybakpath) {
-		var rawdata []byte
-		rawdata, err = dbq.ReadFile(keybakpath)
+	// check backup then legacy backup
+	bakpaths := []string{keybakpath}
+	if dbq.collection.legacyBackups {
+		bakpaths = append(bakpaths, legacyBakPath(keypath))
+	}
+	for _, p := range bakpaths {
+		if !dbq.FileExist(p) {
+			continue
+		}
+		rawdata, err = dbq.readRecord(p, parse)
 		if err == nil {
-			var value []byte
-			value, err = dbq.collection.cipher.Decrypt(rawdata)
-			if err == nil {
-				var data []map[string]any
-				err = json.Unmarshal(value, &data)
-				if err == nil {
-					dbq.WriteFile(keypath, rawdata)
-					var res []Buffer
-					for _, d := range data {
-						res = append(res, types.NewNDict(d))
-					}
-					return res, nil
-				}
+			dbq.metrics.inc(MetricBackupRecoveries)
+			dbq.logKey(slog.LevelWarn, "filedb backup recovery",
+				"read", key, p, start, mainErr)
+			if werr := dbq.writeRepair(key, keypath, rawdata); werr != nil {
+				dbq.logKey(slog.LevelError, "filedb repair failed",
+					"read", key, keypath, start, werr)
 			}
+			return rawdata, nil
 		}
 	}
 
 	return nil, err
 }
 
-// write content to file with exclusive locking
-func (dbq *Query) SetSecure(key string, value []byte) error {
-	if dbq.collection.cipher == nil {
-		return ErrNoSecurity
+// sync key main and backup files from the valid copy
+func (dbq *Query) repair(key string) error {
+	dbc := dbq.collection.sub(dbq.collection.base_path)
+	if dbc.backupPolicy != BackupDisabled {
+		dbc.backupPolicy = BackupVerify
 	}
-	b, err := dbq.collection.cipher.Encrypt(value)
+	q := &Query{FileEngine: dbq.FileEngine, collection: dbc}
+	err := q.read(key, func([]byte) error { return nil })
+	if err != nil && err != ErrNotExist {
+		return err
+	}
+	return nil
+}
+
+// repair backup file if missing or different from main file content
+func (dbq *Query) verifyBackup(
+	key, keybakpath string, rawdata []byte, start time.Time) {
+	if dbq.FileExist(keybakpath) {
+		bakdata, err := dbq.ReadFile(keybakpath)
+		if err == nil && bytes.Equal(bakdata, rawdata) {
+			return
+		}
+	}
+	if err := dbq.writeRepair(key, keybakpath, rawdata); err != nil {
+		dbq.logKey(slog.LevelError, "filedb backup repair failed",
+			"read", key, keybakpath, start, err)
+		return
+	}
+	dbq.logKey(slog.LevelWarn, "filedb backup repaired",
+		"read", key, keybakpath, start, nil)
+}
+
+// write repaired key file, reads only hold read locks so the key write
+// locks are aquired for the write
+func (dbq *Query) writeRepair(key, fpath string, rawdata []byte) error {
+	release, err := dbq.lockKey(key, lockShared)
 	if err != nil {
-		return fmt.Errorf("%w%s", ErrEncrypt, err.Error())
+		return err
 	}
-	return dbq.Set(key, b)
+	defer release()
+	return dbq.WriteFile(fpath, rawdata)
 }
-func (dbq *Query) SetSecureBuffer(key string, value Buffer) error {
-	data, err := json.Marshal(value)
+
+// read and decode record file, returns the raw file content
+func (dbq *Query) readRecord(
+	fpath string, parse func([]byte) error) ([]byte, error) {
+	rawdata, err := dbq.ReadFile(fpath)
 	if err != nil {
-		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+		return nil, err
 	}
-	return dbq.SetSecure(key, data)
+	payload, flags, err := dbq.collection.decodeValue(rawdata)
+	if err != nil {
+		return nil, err
+	}
+	if recordExpired(rawdata, flags) {
+		return nil, ErrNotExist
+	}
+	if err := parse(payload); err != nil {
+		return nil, err
+	}
+	return rawdata, nil
 }
-func (dbq *Query) SetSecureBufferSlice(key string, value []Buffer) error {
-	data, err := json.Marshal(value)
+
+// decrypt value using collection cipher
+func (dbq *Query) decrypt(key string, value []byte) ([]byte, error) {
+	start := time.Now()
+	b, err := dbq.collection.cipher.Decrypt(value)
 	if err != nil {
-		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+		dbq.metrics.inc(MetricDecryptFailures)
+		dbq.logKey(slog.LevelWarn, "filedb decrypt failed", "decrypt",
+			key, dbq.collection.keyPath(key), start, err)
+		return nil, fmt.Errorf("%w - %s", ErrDecrypt, err.Error())
 	}
-	return dbq.SetSecure(key, data)
+	return b, nil
+}
+
+// convert decoded json slice into buffers
+func toBufferSlice(data []map[string]any) []Buffer {
+	var res []Buffer
+	for _, d := range data {
+		res = append(res, types.NewNDict(d))
+	}
+	return res
 }
@@ -0,0 +1,141 @@
+package filedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+)
+
+// on-disk record format, collections with checksum option store values
+// prefixed with a header allowing corruption detection, other collections
+// store raw values which are never decoded:
+//
+//	magic    [4]byte  "FDBR"
+//	version  uint8    record format version
+//	flags    uint8    record flags
+//	reserved [2]byte
+//	length   uint32   payload length
+//	checksum uint32   crc32 of header fields and payload
+//
+// records with the ttl flag set carry the expiry time as unix nanoseconds
+// int64 in the first 8 bytes of payload. headerless files written before
+// the checksum option was enabled are only read as raw values in
+// collections with legacy_values option, otherwise they are corrupted.
+const (
+	recordVersion    = uint8(1)
+	recordHeaderSize = 16
+	recordExpirySize = 8
+
+	// record flags
+	recordFlagTTL = uint8(1)
+)
+
+var recordMagic = []byte("FDBR")
+
+// encode payload into record with header
+func encodeRecord(payload []byte, flags uint8) []byte {
+	buf := make([]byte, recordHeaderSize+len(payload))
+	copy(buf[0:4], recordMagic)
+	buf[4] = recordVersion
+	buf[5] = flags
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(payload)))
+	copy(buf[recordHeaderSize:], payload)
+	binary.BigEndian.PutUint32(buf[12:16], recordChecksum(buf))
+	return buf
+}
+
+// encode payload into record with expiry time
+func encodeExpiringRecord(payload []byte, expiry time.Time) []byte {
+	buf := make([]byte, recordExpirySize+len(payload))
+	binary.BigEndian.PutUint64(buf, uint64(expiry.UnixNano()))
+	copy(buf[recordExpirySize:], payload)
+	return encodeRecord(buf, recordFlagTTL)
+}
+
+// decode record and verify its checksum, data without header is corrupted.
+// the expiry time of records with ttl flag is stripped from payload.
+func decodeRecord(data []byte) ([]byte, uint8, error) {
+	if len(data) < recordHeaderSize || !bytes.HasPrefix(data, recordMagic) {
+		return nil, 0, ErrCorrupt
+	}
+	if data[4] != recordVersion {
+		return nil, 0, ErrCorrupt
+	}
+	length := binary.BigEndian.Uint32(data[8:12])
+	if uint64(len(data)) != uint64(recordHeaderSize)+uint64(length) {
+		return nil, 0, ErrCorrupt
+	}
+	if binary.BigEndian.Uint32(data[12:16]) != recordChecksum(data) {
+		return nil, 0, ErrCorrupt
+	}
+	flags := data[5]
+	if flags&recordFlagTTL != 0 {
+		if length < recordExpirySize {
+			return nil, 0, ErrCorrupt
+		}
+		return data[recordHeaderSize+recordExpirySize:], flags, nil
+	}
+	return data[recordHeaderSize:], flags, nil
+}
+
+// encode key value for storing, values are written as records in
+// collections with checksum option
+func (dbc *Collection) encodeValue(value []byte) []byte {
+	if dbc.checksum {
+		return encodeRecord(value, 0)
+	}
+	return value
+}
+
+// decode stored key value, values are only decoded as records in
+// collections with checksum option so raw values starting with the
+// record magic are returned as is. headerless values are returned as is
+// only in collections with legacy_values option.
+func (dbc *Collection) decodeValue(data []byte) ([]byte, uint8, error) {
+	if !dbc.checksum {
+		return data, 0, nil
+	}
+	if dbc.legacyValues && !bytes.HasPrefix(data, recordMagic) {
+		return data, 0, nil
+	}
+	return decodeRecord(data)
+}
+
+// check if decoded record with ttl flag is expired
+func recordExpired(data []byte, flags uint8) bool {
+	if flags&recordFlagTTL == 0 {
+		return false
+	}
+	expiry := int64(binary.BigEndian.Uint64(
+		data[recordHeaderSize : recordHeaderSize+recordExpirySize]))
+	return time.Now().UnixNano() >= expiry
+}
+
+// check if record header with ttl flag holds an expired time, head is
+// the start of record holding the header and expiry time
+func headerExpired(head []byte) bool {
+	if len(head) < recordHeaderSize+recordExpirySize ||
+		!bytes.HasPrefix(head, recordMagic) || head[4] != recordVersion {
+		return false
+	}
+	return recordExpired(head, head[5])
+}
+
+// get expiry time of encoded record with ttl flag
+func recordExpiry(data []byte) (time.Time, bool) {
+	_, flags, err := decodeRecord(data)
+	if err != nil || flags&recordFlagTTL == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(
+		data[recordHeaderSize:recordHeaderSize+recordExpirySize]))), true
+}
+
+// calc record checksum excluding the checksum field
+func recordChecksum(data []byte) uint32 {
+	h := crc32.NewIEEE()
+	h.Write(data[0:12])
+	h.Write(data[recordHeaderSize:])
+	return h.Sum32()
+}
@@ -0,0 +1,141 @@
+package filedb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecodeRecord(t *testing.T) {
+	valid := encodeRecord([]byte("value"), 0)
+	flipped := bytes.Clone(valid)
+	flipped[len(flipped)-1] ^= 0x01
+	badVersion := bytes.Clone(valid)
+	badVersion[4] = recordVersion + 1
+	badMagic := bytes.Clone(valid)
+	badMagic[0] ^= 0x01
+	expiring := encodeExpiringRecord([]byte("value"), time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		payload []byte
+		flags   uint8
+		err     error
+	}{
+		{"valid", valid, []byte("value"), 0, nil},
+		{"headerless", []byte("raw value of key"), nil, 0, ErrCorrupt},
+		{"empty", []byte{}, nil, 0, ErrCorrupt},
+		{"magic prefix", valid[:3], nil, 0, ErrCorrupt},
+		{"bad magic", badMagic, nil, 0, ErrCorrupt},
+		{"expiring", expiring, []byte("value"), recordFlagTTL, nil},
+		{"bit flip", flipped, nil, 0, ErrCorrupt},
+		{"truncated", valid[:len(valid)-2], nil, 0, ErrCorrupt},
+		{"short header", valid[:8], nil, 0, ErrCorrupt},
+		{"bad version", badVersion, nil, 0, ErrCorrupt},
+	}
+	for _, tt := range tests {
+		payload, flags, err := decodeRecord(tt.data)
+		if err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+			continue
+		}
+		if !bytes.Equal(payload, tt.payload) || flags != tt.flags {
+			t.Errorf("%s: expected %q %d, got %q %d",
+				tt.name, tt.payload, tt.flags, payload, flags)
+		}
+	}
+}
+
+func TestChecksumBackupFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func([]byte) []byte
+	}{
+		{"bit flip", func(b []byte) []byte {
+			b = bytes.Clone(b)
+			b[len(b)-1] ^= 0x01
+			return b
+		}},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-1] }},
+		{"truncated to magic", func(b []byte) []byte { return b[:3] }},
+		{"empty", func(b []byte) []byte { return []byte{} }},
+		{"bad magic", func(b []byte) []byte {
+			b = bytes.Clone(b)
+			b[0] ^= 0x01
+			return b
+		}},
+		{"bad length", func(b []byte) []byte {
+			b = bytes.Clone(b)
+			b[11]++
+			return b
+		}},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(t, Options{"checksum": true})
+		q := dbc.Query()
+		if err := q.Set("k", []byte("good")); err != nil {
+			t.Fatal(err)
+		}
+		rawdata, _ := st.ReadFile("/db/k")
+		st.WriteFile("/db/k", tt.corrupt(rawdata), 0o664)
+
+		value, err := q.Get("k")
+		if err != nil || string(value) != "good" {
+			t.Errorf("%s: expected backup value, got %q %v", tt.name, value, err)
+		}
+		// main file is repaired from backup
+		checkFile(t, st, "/db/k", rawdata)
+	}
+}
+
+func TestRawValuesNotDecoded(t *testing.T) {
+	// values starting with the record magic are stored raw in
+	// collections without checksum option
+	payload := encodeRecord([]byte("inner"), 0)
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"record payload", payload},
+		{"corrupt record payload", payload[:len(payload)-1]},
+		{"magic only", []byte("FDBR")},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(t, nil)
+		q := dbc.Query()
+		if err := q.Set("k", tt.value); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, st, "/db/k", tt.value)
+		value, err := q.Get("k")
+		if err != nil || !bytes.Equal(value, tt.value) {
+			t.Errorf("%s: expected %q, got %q %v", tt.name, tt.value, value, err)
+		}
+	}
+}
+
+func TestHeaderlessFilesWithChecksum(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy bool
+		err    error
+	}{
+		{"legacy values", true, nil},
+		{"strict", false, ErrCorrupt},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(
+			t, Options{"checksum": true, "legacy_values": tt.legacy})
+		st.MkdirAll("/db", 0o775)
+		st.WriteFile("/db/k", []byte("legacy"), 0o664)
+		value, err := dbc.Query().Get("k")
+		if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+		if err == nil && string(value) != "legacy" {
+			t.Errorf("%s: expected legacy value, got %q", tt.name, value)
+		}
+	}
+}
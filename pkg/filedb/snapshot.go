@@ -0,0 +1,364 @@
+package filedb
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// snapshots are point in time copies of a collection tree kept in a
+// hidden dir of the collection, one dir per snapshot name. snapshots are
+// taken holding the collection exclusive lock, so writers of the
+// collection and all its nested collections and indexes are paused and
+// the copy never mixes old and new values. files are hard linked when
+// the storage supports it, this is safe as files are never modified in
+// place but replaced on write.
+const (
+	snapshotDir = ".snapshots"
+	// staging dir of restores in progress
+	snapshotRestoreDir = ".restore"
+)
+
+// Linker is implemented by storage backends supporting hard links, used
+// by snapshots to avoid copying file contents
+type Linker interface {
+	// create newpath as hard link to oldpath
+	Link(oldpath, newpath string) error
+}
+
+// create consistent snapshot of collection tree with name, a time based
+// name is generated if name is empty. returns the snapshot name.
+func (dbc *Collection) Snapshot(name string) (snapname string, err error) {
+	defer dbc.logOp("snapshot", time.Now(), &err, slog.String("name", name))
+
+	if dbc.keyErr != nil {
+		return "", dbc.keyErr
+	}
+	if name == "" {
+		t := time.Now().UTC()
+		name = fmt.Sprintf("%s%09d", t.Format("20060102T150405"), t.Nanosecond())
+	} else if err := checkSnapshotName(name); err != nil {
+		return "", err
+	}
+	if !dbc.IsExist() {
+		return "", fmt.Errorf("%w - collection %s", ErrNotExist, dbc.base_path)
+	}
+
+	err = dbc.withTreeLock(dbc.Query().FileEngine, func(*Query) error {
+		dstpath := dbc.snapshotPath(name)
+		if _, err := dbc.storage.Stat(dstpath); err == nil {
+			return fmt.Errorf("%w - snapshot %s", ErrExist, name)
+		}
+
+		// snapshot is copied into temp dir then renamed, so unfinished
+		// snapshots are never listed
+		tmppath := dbc.snapshotPath("." + name + fileTmpSuffix)
+		if err := dbc.storage.RemoveAll(tmppath); err != nil {
+			return fmt.Errorf("%w%s", ErrError, err.Error())
+		}
+		if err := dbc.snapshotTree(dbc.base_path, tmppath); err != nil {
+			dbc.storage.RemoveAll(tmppath)
+			return fmt.Errorf("%w%s", ErrError, err.Error())
+		}
+		if err := dbc.storage.Rename(tmppath, dstpath); err != nil {
+			dbc.storage.RemoveAll(tmppath)
+			return fmt.Errorf("%w%s", ErrError, err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// replace collection tree with snapshot content, the snapshot is kept.
+// the restore is logged in journal and completed by Recover if
+// interrupted after the current content removal started, unfinished
+// restores are completed before starting a new one.
+func (dbc *Collection) Restore(name string) (err error) {
+	defer dbc.logOp("restore", time.Now(), &err, slog.String("name", name))
+
+	if dbc.keyErr != nil {
+		return dbc.keyErr
+	}
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	snappath := dbc.snapshotPath(name)
+	finfo, err := dbc.storage.Stat(snappath)
+	if err != nil || !finfo.IsDir() {
+		return fmt.Errorf("%w - snapshot %s", ErrNotExist, name)
+	}
+
+	return dbc.withTreeLock(dbc.Query().FileEngine, func(dbq *Query) error {
+		if dbc.restorePending() {
+			if err := dbc.recoverJournal(dbq); err != nil {
+				return err
+			}
+		}
+
+		// stage snapshot copy next to snapshots to swap it in with renames
+		staging := dbc.snapshotPath(snapshotRestoreDir)
+		if err := dbc.storage.RemoveAll(staging); err != nil {
+			return fmt.Errorf("%w%s", ErrError, err.Error())
+		}
+		if err := dbc.snapshotTree(snappath, staging); err != nil {
+			dbc.storage.RemoveAll(staging)
+			return fmt.Errorf("%w%s", ErrError, err.Error())
+		}
+
+		jpath := dbc.newJournalPath(journalRestore)
+		entry := &journalEntry{Type: journalRestore, Src: dbc.relPath(staging)}
+		if err := dbc.writeJournal(dbq, jpath, entry); err != nil {
+			dbc.storage.RemoveAll(staging)
+			return err
+		}
+		if err := dbc.restoreStaged(dbq, jpath, entry); err != nil {
+			return err
+		}
+		return dbq.PurgeFile(jpath)
+	})
+}
+
+// remove collection content then move staged restore content in, the
+// journal entry is updated once the removal is complete so interrupted
+// swaps never remove restored content
+func (dbc *Collection) restoreStaged(
+	dbq *Query, jpath string, entry *journalEntry) error {
+	staging, err := dbc.relJoin(entry.Src)
+	if err != nil {
+		return err
+	}
+
+	if entry.Phase != journalPhaseSwap {
+		entries, err := dbc.storage.ReadDir(dbc.base_path)
+		if err != nil {
+			return fmt.Errorf("%w%s", ErrError, err.Error())
+		}
+		for _, e := range entries {
+			switch e.Name() {
+			case snapshotDir, journalDir, collectionLockFile:
+				continue
+			}
+			err := dbc.storage.RemoveAll(filepath.Join(dbc.base_path, e.Name()))
+			if err != nil {
+				return fmt.Errorf("%w%s", ErrError, err.Error())
+			}
+		}
+		entry.Phase = journalPhaseSwap
+		if err := dbc.writeJournal(dbq, jpath, entry); err != nil {
+			return err
+		}
+	}
+
+	entries, err := dbc.storage.ReadDir(staging)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+	for _, e := range entries {
+		err := dbc.storage.Rename(filepath.Join(staging, e.Name()),
+			filepath.Join(dbc.base_path, e.Name()))
+		if err != nil {
+			return fmt.Errorf("%w%s", ErrError, err.Error())
+		}
+	}
+	return dbc.storage.RemoveAll(staging)
+}
+
+// list collection snapshots names ordered from oldest to newest
+func (dbc *Collection) ListSnapshots() ([]string, error) {
+	if dbc.keyErr != nil {
+		return nil, dbc.keyErr
+	}
+	entries, err := dbc.storage.ReadDir(dbc.snapshotPath(""))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+
+	type snapshot struct {
+		name  string
+		mtime time.Time
+	}
+	snapshots := []snapshot{}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		finfo, err := e.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot{e.Name(), finfo.ModTime()})
+	}
+	slices.SortStableFunc(snapshots, func(a, b snapshot) int {
+		return a.mtime.Compare(b.mtime)
+	})
+
+	res := make([]string, len(snapshots))
+	for i, s := range snapshots {
+		res[i] = s.name
+	}
+	return res, nil
+}
+
+// delete collection snapshot
+func (dbc *Collection) DeleteSnapshot(name string) (err error) {
+	defer dbc.logOp("delete_snapshot", time.Now(), &err,
+		slog.String("name", name))
+
+	if dbc.keyErr != nil {
+		return dbc.keyErr
+	}
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	release, err := dbc.lockStructure(dbc.Query().FileEngine)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := dbc.storage.RemoveAll(dbc.snapshotPath(name)); err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+	return nil
+}
+
+// delete oldest snapshots keeping the newest keep snapshots, leftovers
+// of interrupted snapshots are removed too. returns number of deleted
+// snapshots.
+func (dbc *Collection) PruneSnapshots(keep int) (count int, err error) {
+	defer dbc.logOp("prune_snapshots", time.Now(), &err)
+
+	if dbc.keyErr != nil {
+		return 0, dbc.keyErr
+	}
+	release, err := dbc.lockStructure(dbc.Query().FileEngine)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	names, err := dbc.ListSnapshots()
+	if err != nil {
+		return 0, err
+	}
+	for len(names)-count > max(keep, 0) {
+		if dbc.ctx.Err() != nil {
+			return count, ctxError(dbc.ctx)
+		}
+		err := dbc.storage.RemoveAll(dbc.snapshotPath(names[count]))
+		if err != nil {
+			return count, fmt.Errorf("%w%s", ErrError, err.Error())
+		}
+		count++
+	}
+
+	// snapshots hold the collection lock, so temp dirs are leftovers.
+	// restore staging dirs are leftovers unless needed by Recover.
+	entries, err := dbc.storage.ReadDir(dbc.snapshotPath(""))
+	if err != nil {
+		return count, nil
+	}
+	for _, e := range entries {
+		n := e.Name()
+		if !e.IsDir() {
+			continue
+		}
+		if isTempFile(n) || (n == snapshotRestoreDir && !dbc.restorePending()) {
+			dbc.storage.RemoveAll(dbc.snapshotPath(n))
+		}
+	}
+	return count, nil
+}
+
+// check if journal holds an unfinished restore, its staged content must
+// be kept for Recover
+func (dbc *Collection) restorePending() bool {
+	entries, err := dbc.storage.ReadDir(dbc.journalPath(""))
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		return true
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), "_"+journalRestore+journalSuffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// check snapshot name is a valid single key segment
+func checkSnapshotName(name string) error {
+	if strings.Contains(name, keySep) {
+		return fmt.Errorf("%w - invalid snapshot name: %q", ErrKeyFormat, name)
+	}
+	return ValidateKey(name)
+}
+
+// get path of snapshot in collection snapshots dir
+func (dbc *Collection) snapshotPath(name string) string {
+	return filepath.Join(dbc.base_path, snapshotDir, name)
+}
+
+// copy collection tree from src to dst skipping snapshots, journal, lock
+// and temp files. files are hard linked if supported by storage.
+func (dbc *Collection) snapshotTree(src, dst string) error {
+	if dbc.ctx.Err() != nil {
+		return ctxError(dbc.ctx)
+	}
+	info, err := dbc.storage.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := dbc.storage.MkdirAll(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	entries, err := dbc.storage.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		n := e.Name()
+		switch {
+		case n == snapshotDir || n == journalDir || n == collectionLockFile:
+		case isTempFile(n):
+		case e.IsDir():
+			err = dbc.snapshotTree(filepath.Join(src, n), filepath.Join(dst, n))
+		case e.Type().IsRegular():
+			err = dbc.linkFile(filepath.Join(src, n), filepath.Join(dst, n))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hard link file if supported by storage, falls back to copy
+func (dbc *Collection) linkFile(src, dst string) error {
+	if l, ok := dbc.storage.(Linker); ok {
+		if err := l.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+	info, err := dbc.storage.Stat(src)
+	if err != nil {
+		return err
+	}
+	data, err := dbc.storage.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return dbc.storage.WriteFile(dst, data, info.Mode().Perm())
+}
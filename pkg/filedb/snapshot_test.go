@@ -0,0 +1,121 @@
+package filedb
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dbc, st := newMemCollection(t, nil)
+	q := dbc.Query()
+	q.Set("a", []byte("1"))
+	q.Set("c.k", []byte("2"))
+	dbc.Index("ix").Mark("a")
+
+	name, err := dbc.Snapshot("s1")
+	if err != nil || name != "s1" {
+		t.Fatalf("expected snapshot, got %q %v", name, err)
+	}
+	q.Set("a", []byte("changed"))
+	q.Set("n", []byte("new"))
+	dbc.Index("ix").Clear("a")
+
+	if err := dbc.Restore("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := q.Get("a"); string(value) != "1" {
+		t.Errorf("expected restored value, got %q", value)
+	}
+	if value, _ := q.Get("c.k"); string(value) != "2" {
+		t.Errorf("expected restored child value, got %q", value)
+	}
+	if q.IsExist("n") {
+		t.Error("expected key written after snapshot removed")
+	}
+	if !dbc.Index("ix").Check("a") {
+		t.Error("expected restored index mark")
+	}
+	// snapshot is kept and no staging or journal is left
+	if names, _ := dbc.ListSnapshots(); !slices.Equal(names, []string{"s1"}) {
+		t.Errorf("expected kept snapshot, got %v", names)
+	}
+	if _, err := st.Stat(dbc.snapshotPath(snapshotRestoreDir)); err == nil {
+		t.Error("unexpected restore staging dir")
+	}
+	if entries, _ := st.ReadDir(dbc.journalPath("")); len(entries) != 0 {
+		t.Errorf("unexpected journal entries %d", len(entries))
+	}
+}
+
+func TestSnapshotNames(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"s1", nil},
+		{"s1", ErrExist},
+		{"a.b", ErrKeyFormat},
+		{"../x", ErrKeyFormat},
+		{".hidden", ErrKeyFormat},
+	}
+	dbc, _ := newMemCollection(t, nil)
+	dbc.Query().Set("a", []byte("1"))
+	for _, tt := range tests {
+		_, err := dbc.Snapshot(tt.name)
+		if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+	}
+	if err := dbc.Restore("missing"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+	if _, err := dbc.Child("..").PruneSnapshots(0); !errors.Is(err, ErrKeyFormat) {
+		t.Errorf("expected key format error, got %v", err)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	tests := []struct {
+		name    string
+		keep    int
+		pending bool
+		count   int
+		staging bool
+	}{
+		{"keep all", 5, false, 0, false},
+		{"keep newest", 1, false, 2, false},
+		{"negative keep", -1, false, 3, false},
+		{"pending restore", 5, true, 0, true},
+	}
+	for _, tt := range tests {
+		dbc, st := newMemCollection(t, nil)
+		dbc.Query().Set("a", []byte("1"))
+		for _, n := range []string{"s1", "s2", "s3"} {
+			dbc.Snapshot(n)
+		}
+		st.MkdirAll(dbc.snapshotPath(".s4"+fileTmpSuffix), 0o775)
+		st.MkdirAll(dbc.snapshotPath(snapshotRestoreDir), 0o775)
+		if tt.pending {
+			st.MkdirAll(dbc.journalPath(""), 0o775)
+			st.TouchFile(dbc.newJournalPath(journalRestore), 0o664)
+		}
+
+		count, err := dbc.PruneSnapshots(tt.keep)
+		if err != nil || count != tt.count {
+			t.Errorf("%s: expected %d pruned, got %d %v",
+				tt.name, tt.count, count, err)
+		}
+		names, _ := dbc.ListSnapshots()
+		if len(names) != 3-tt.count {
+			t.Errorf("%s: unexpected snapshots %v", tt.name, names)
+		}
+		if _, err := st.Stat(dbc.snapshotPath(".s4" + fileTmpSuffix)); err == nil {
+			t.Errorf("%s: expected temp snapshot removed", tt.name)
+		}
+		_, err = st.Stat(dbc.snapshotPath(snapshotRestoreDir))
+		if (err == nil) != tt.staging {
+			t.Errorf("%s: unexpected restore staging state", tt.name)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package filedb
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Storage defines the primitive operations of a storage backend used by
+// Collection and Query. all paths are absolute paths built from the
+// collection base path, not found errors must satisfy os.IsNotExist.
+type Storage interface {
+	// return file or dir info
+	Stat(path string) (fs.FileInfo, error)
+	// list dir entries sorted by name
+	ReadDir(path string) ([]fs.DirEntry, error)
+	// create dir tree if not exist
+	MkdirAll(path string, perm fs.FileMode) error
+	// read whole file content
+	ReadFile(path string) ([]byte, error)
+	// write whole file content atomically replacing existing file
+	WriteFile(path string, data []byte, perm fs.FileMode) error
+	// create empty file if not exist
+	TouchFile(path string, perm fs.FileMode) error
+	// remove file or empty dir
+	Remove(path string) error
+	// remove path and all its children
+	RemoveAll(path string) error
+	// rename file or dir tree
+	Rename(oldpath, newpath string) error
+	// try to lock path without blocking, returns ErrLocked if the lock is
+	// held by others. the returned func releases the lock.
+	TryLock(path string, exclusive bool) (func(), error)
+}
+
+// default filesystem storage
+var defaultStorage Storage = NewOsStorage()
+
+// OsStorage is the filesystem storage backend using flock for locking
+type OsStorage struct{}
+
+// create new filesystem storage
+func NewOsStorage() *OsStorage {
+	return &OsStorage{}
+}
+
+func (st *OsStorage) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (st *OsStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	return os.ReadDir(path)
+}
+
+func (st *OsStorage) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (st *OsStorage) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+// read up to n bytes from start of file, implements HeadReader
+func (st *OsStorage) ReadHead(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, n)
+	n, err = io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// write content to a temp file in the same dir, sync it to disk and
+// then rename it over the target file
+func (st *OsStorage) WriteFile(
+	path string, data []byte, perm fs.FileMode) error {
+	f, err := st.createTempFile(path, perm)
+	if err != nil {
+		return err
+	}
+	tmppath := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmppath, path)
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+
+	// sync parent dir to persist the rename
+	return syncDir(filepath.Dir(path))
+}
+
+func (st *OsStorage) TouchFile(path string, perm fs.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (st *OsStorage) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (st *OsStorage) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (st *OsStorage) Rename(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(newpath))
+}
+
+// create hard link, implements Linker
+func (st *OsStorage) Link(oldpath, newpath string) error {
+	return os.Link(oldpath, newpath)
+}
+
+// lock file or dir using flock, non existing path is created as
+// empty lock file
+func (st *OsStorage) TryLock(path string, exclusive bool) (func(), error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		f, err = os.OpenFile(
+			path, os.O_RDONLY|os.O_CREATE, os.FileMode(defaultFilePerm))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN|unix.LOCK_NB)
+		f.Close()
+	}, nil
+}
+
+// create new hidden temp file in the same dir as target file
+func (st *OsStorage) createTempFile(
+	path string, perm fs.FileMode) (*os.File, error) {
+	dirpath, name := filepath.Split(path)
+	for {
+		tmppath := filepath.Join(dirpath, fmt.Sprintf(
+			".%s.%08x%s", name, rand.Uint32(), fileTmpSuffix))
+		f, err := os.OpenFile(
+			tmppath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+}
+
+// check if name is a temp file name created by atomic writes
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, fileTmpSuffix)
+}
+
+// sync dir entries to disk
+func syncDir(dirpath string) error {
+	d, err := os.Open(dirpath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
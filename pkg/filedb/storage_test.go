@@ -0,0 +1,74 @@
+package filedb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAtomicWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	dbe := NewFileEngine()
+	fpath := filepath.Join(dir, "c", "k")
+	tests := []struct {
+		name string
+		path string
+		data string
+		err  bool
+		want string
+	}{
+		{"new file", fpath, "v1", false, "v1"},
+		{"replace file", fpath, "v2", false, "v2"},
+		{"empty value", fpath, "", false, ""},
+		{"target is dir", filepath.Join(dir, "c"), "x", true, ""},
+	}
+	for _, tt := range tests {
+		err := dbe.WriteFile(tt.path, []byte(tt.data))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if tt.err {
+			continue
+		}
+		if data, err := os.ReadFile(tt.path); err != nil || string(data) != tt.want {
+			t.Errorf("%s: expected %q, got %q %v", tt.name, tt.want, data, err)
+		}
+	}
+
+	// no temp files are left by writes or failed writes
+	entries, _ := os.ReadDir(filepath.Join(dir, "c"))
+	for _, e := range entries {
+		if isTempFile(e.Name()) {
+			t.Errorf("unexpected temp file %s", e.Name())
+		}
+	}
+}
+
+func TestConcurrentWritesNeverPartial(t *testing.T) {
+	dbe := NewFileEngine()
+	fpath := filepath.Join(t.TempDir(), "k")
+	values := map[string]bool{}
+	var wg sync.WaitGroup
+	for _, c := range "abcd" {
+		value := strings.Repeat(string(c), 4096)
+		values[value] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := dbe.WriteFile(fpath, []byte(value)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if data, err := os.ReadFile(fpath); err == nil && !values[string(data)] {
+			t.Fatalf("read partial content of %d bytes", len(data))
+		}
+	}
+	wg.Wait()
+}
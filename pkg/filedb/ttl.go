@@ -0,0 +1,177 @@
+package filedb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// keys written with ttl are stored as records holding their expiry time,
+// so ttl requires the checksum option. expired keys read as not existing
+// until they are deleted by Sweep, writing the key again with Set clears
+// its ttl.
+
+// write key value expiring after ttl
+func (dbq *Query) SetWithTTL(
+	key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%winvalid ttl value", ErrError)
+	}
+	if err := dbq.collection.checkTTL(); err != nil {
+		return err
+	}
+	return dbq.write(key, encodeExpiringRecord(value, time.Now().Add(ttl)))
+}
+func (dbq *Query) SetBufferWithTTL(
+	key string, value Buffer, ttl time.Duration) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+	return dbq.SetWithTTL(key, data, ttl)
+}
+
+// delete expired keys with their backups in collection and all its child
+// collections, returns number of deleted keys
+func (dbc *Collection) Sweep() (int, error) {
+	if dbc.keyErr != nil {
+		return 0, dbc.keyErr
+	}
+	if !dbc.IsExist() {
+		return 0, nil
+	}
+
+	dbq := dbc.Query()
+	keys, err := dbq.keys()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		if dbc.ctx.Err() != nil {
+			return count, ctxError(dbc.ctx)
+		}
+		if !dbq.isExpired(dbc.keyPath(key)) {
+			continue
+		}
+		// expiry is checked again holding the key lock, the key may
+		// have been written again meanwhile
+		deleted := false
+		err := dbq.withKeyLock(key, func(q *Query) error {
+			if !q.isExpired(dbc.keyPath(key)) {
+				return nil
+			}
+			deleted = true
+			return q.Delete(key)
+		})
+		if err != nil {
+			return count, err
+		}
+		if deleted {
+			count++
+		}
+	}
+
+	childs, err := dbc.ListChilds()
+	if err != nil {
+		return count, err
+	}
+	for _, k := range childs {
+		n, err := dbc.Child(k).Sweep()
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// check collection stores values as records able to hold expiry time
+func (dbc *Collection) checkTTL() error {
+	if !dbc.checksum {
+		return fmt.Errorf("%wttl requires checksum option", ErrError)
+	}
+	return nil
+}
+
+// check if key file holds an expired record, only the record header is
+// read so the record checksum is verified by reads not by expiry checks
+func (dbq *Query) isExpired(keypath string) bool {
+	if !dbq.collection.checksum {
+		return false
+	}
+	head, err := dbq.readHead(keypath, recordHeaderSize+recordExpirySize)
+	if err != nil {
+		return false
+	}
+	return headerExpired(head)
+}
+
+// HeadReader is implemented by storage backends able to read the start
+// of files, used by expiry checks to avoid reading whole values
+type HeadReader interface {
+	// read up to n bytes from start of file
+	ReadHead(path string, n int) ([]byte, error)
+}
+
+// read up to n bytes from start of file, falls back to reading the whole
+// file if not supported by storage
+func (dbe *FileEngine) readHead(fpath string, n int) ([]byte, error) {
+	if dbe.ctx.Err() != nil {
+		return nil, ctxError(dbe.ctx)
+	}
+	if hr, ok := dbe.storage.(HeadReader); ok {
+		data, err := hr.ReadHead(fpath, n)
+		if err != nil {
+			return nil, fmt.Errorf("%w - %s", ErrRead, err.Error())
+		}
+		return data, nil
+	}
+	data, err := dbe.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return data[:min(n, len(data))], nil
+}
+
+// Sweeper runs Sweep periodically on a collection in background
+type Sweeper struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start background sweeper running every interval until stopped or the
+// collection context is done, sweep errors are ignored and retried on
+// the next run.
+func (dbc *Collection) StartSweeper(interval time.Duration) (*Sweeper, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("%winvalid sweep interval", ErrError)
+	}
+	ctx, cancel := context.WithCancel(dbc.ctx)
+	s := &Sweeper{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		c := dbc.WithContext(ctx)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.Sweep()
+			}
+		}
+	}()
+	return s, nil
+}
+
+// stop sweeper and wait for running sweep to finish
+func (s *Sweeper) Stop() {
+	s.cancel()
+	<-s.done
+}
@@ -0,0 +1,110 @@
+package filedb
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSetWithTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum bool
+		ttl      time.Duration
+		ok       bool
+	}{
+		{"checksum collection", true, time.Hour, true},
+		{"raw collection", false, time.Hour, false},
+		{"zero ttl", true, 0, false},
+		{"negative ttl", true, -time.Second, false},
+	}
+	for _, tt := range tests {
+		dbc, _ := newMemCollection(t, Options{"checksum": tt.checksum})
+		q := dbc.Query()
+		err := q.SetWithTTL("k", []byte("v"), tt.ttl)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if q.IsExist("k") != tt.ok {
+			t.Errorf("%s: unexpected key state", tt.name)
+		}
+	}
+}
+
+func TestExpiredKeys(t *testing.T) {
+	dbc, st := newMemCollection(t, Options{"checksum": true})
+	q := dbc.Query()
+	q.Set("keep", []byte("k"))
+	q.SetWithTTL("live", []byte("l"), time.Hour)
+	past := time.Now().Add(-time.Second)
+	q.write("gone", encodeExpiringRecord([]byte("g"), past))
+	dbc.Child("c").Query().write("gone", encodeExpiringRecord([]byte("g"), past))
+
+	if _, err := q.Get("gone"); err != ErrNotExist {
+		t.Errorf("expected expired key not to exist, got %v", err)
+	}
+	if q.IsExist("gone") {
+		t.Error("expected expired key not to exist")
+	}
+	keys, _ := q.Keys()
+	if !slices.Equal(keys, []string{"keep", "live"}) {
+		t.Errorf("expected unexpired keys, got %v", keys)
+	}
+
+	count, err := dbc.Sweep()
+	if err != nil || count != 2 {
+		t.Errorf("expected 2 swept keys, got %d %v", count, err)
+	}
+	for _, p := range []string{"/db/gone", "/db/.bak/gone", "/db/c/gone"} {
+		checkFile(t, st, p, nil)
+	}
+	if value, err := q.Get("live"); err != nil || string(value) != "l" {
+		t.Errorf("expected live key, got %q %v", value, err)
+	}
+}
+
+func TestHeaderExpired(t *testing.T) {
+	past := encodeExpiringRecord([]byte("v"), time.Now().Add(-time.Second))
+	future := encodeExpiringRecord([]byte("v"), time.Now().Add(time.Hour))
+	tests := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"expired", past, true},
+		{"expired head only", past[:recordHeaderSize+recordExpirySize], true},
+		{"not expired", future, false},
+		{"no ttl", encodeRecord([]byte("value of key"), 0), false},
+		{"raw value", []byte("FDBX raw value of key"), false},
+		{"short", past[:recordHeaderSize], false},
+	}
+	for _, tt := range tests {
+		if got := headerExpired(tt.head); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	dbc, _ := newMemCollection(t, Options{"checksum": true})
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if _, err := dbc.StartSweeper(interval); err == nil {
+			t.Errorf("expected error for interval %v", interval)
+		}
+	}
+
+	q := dbc.Query()
+	q.write("k", encodeExpiringRecord([]byte("v"), time.Now()))
+	s, err := dbc.StartSweeper(5 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	for i := 0; i < 100; i++ {
+		if keys, _ := q.keys(); len(keys) == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("expected expired key deleted by sweeper")
+}
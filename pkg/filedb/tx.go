@@ -0,0 +1,290 @@
+package filedb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/exonlabs/go-utils/pkg/types"
+)
+
+// transaction operation types
+const (
+	txSet    = "set"
+	txDelete = "delete"
+	txMark   = "mark"
+	txClear  = "clear"
+)
+
+// transaction operation with the state of its key before the commit,
+// the raw record of key or if the index mark existed, used to undo the
+// operation when the commit fails
+type txOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Index string `json:"index,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Exist bool   `json:"exist,omitempty"`
+	Prev  []byte `json:"prev,omitempty"`
+}
+
+// Tx stages key and index operations on a collection and applies them
+// on Commit. committed operations are logged in the collection journal
+// with the previous state of their keys first, so they are either fully
+// applied or replayed by Recover after a crash. commits failing while
+// applying operations are undone from the logged states, or by Recover
+// if the undo fails too. journals are not processed when collections are
+// created, Recover must be called before using collections that may have
+// been interrupted. transactions are not isolated from concurrent writers.
+type Tx struct {
+	collection *Collection
+	query      *Query
+	ops        []txOp
+	done       bool
+}
+
+// start new transaction, committed transactions interrupted in previous
+// runs are replayed by Recover
+func (dbc *Collection) Begin() (*Tx, error) {
+	if dbc.keyErr != nil {
+		return nil, dbc.keyErr
+	}
+	return &Tx{
+		collection: dbc,
+		query:      dbc.Query(),
+	}, nil
+}
+
+// read key value, staged operations of the transaction are visible
+func (tx *Tx) Get(key string) ([]byte, error) {
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		op := tx.ops[i]
+		if op.Index != "" || op.Key != key {
+			continue
+		}
+		if op.Op == txDelete {
+			return nil, ErrNotExist
+		}
+		return op.Value, nil
+	}
+	return tx.query.Get(key)
+}
+func (tx *Tx) GetBuffer(key string) (Buffer, error) {
+	b, err := tx.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]any
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("%w - %s", ErrRead, err.Error())
+	}
+	return types.NewNDict(data), nil
+}
+
+func (tx *Tx) Set(key string, value []byte) error {
+	return tx.stage(txOp{Op: txSet, Key: key, Value: value})
+}
+func (tx *Tx) SetBuffer(key string, value Buffer) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+	return tx.Set(key, data)
+}
+
+func (tx *Tx) Delete(key string) error {
+	return tx.stage(txOp{Op: txDelete, Key: key})
+}
+
+// read and decrypt key value, staged operations are visible
+func (tx *Tx) GetSecure(key string) ([]byte, error) {
+	if tx.collection.cipher == nil {
+		return nil, ErrNoSecurity
+	}
+	b, err := tx.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return tx.query.decrypt(key, b)
+}
+func (tx *Tx) GetSecureBuffer(key string) (Buffer, error) {
+	b, err := tx.GetSecure(key)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]any
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("%w - %s", ErrRead, err.Error())
+	}
+	return types.NewNDict(data), nil
+}
+
+// encrypt and stage key value
+func (tx *Tx) SetSecure(key string, value []byte) error {
+	if tx.collection.cipher == nil {
+		return ErrNoSecurity
+	}
+	b, err := tx.collection.cipher.Encrypt(value)
+	if err != nil {
+		return fmt.Errorf("%w%s", ErrEncrypt, err.Error())
+	}
+	return tx.Set(key, b)
+}
+func (tx *Tx) SetSecureBuffer(key string, value Buffer) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+	return tx.SetSecure(key, data)
+}
+
+// mark key in collection index
+func (tx *Tx) Mark(index, key string) error {
+	return tx.stage(txOp{Op: txMark, Key: key, Index: index})
+}
+
+// clear key from collection index
+func (tx *Tx) Clear(index, key string) error {
+	return tx.stage(txOp{Op: txClear, Key: key, Index: index})
+}
+
+// log staged operations to journal then apply them, the collection lock
+// is held shared until the journal entry is removed so Recover never
+// replays transactions still being applied. on failure the applied
+// operations are undone and the apply error is returned.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("%wtransaction already done", ErrError)
+	}
+	tx.done = true
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	dbc, dbq := tx.collection, tx.query
+	release, err := dbc.lockChain(dbq.FileEngine, dbc.base_path, lockShared)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ops, err := dbc.txStates(dbq, tx.ops)
+	if err != nil {
+		return err
+	}
+	jpath := dbc.newJournalPath(journalTx)
+	entry := &journalEntry{Type: journalTx, Ops: ops}
+	if err := dbc.writeJournal(dbq, jpath, entry); err != nil {
+		return err
+	}
+	if err := dbc.applyTxOps(dbq, ops); err != nil {
+		// journal is kept for Recover if the undo is not completed
+		entry.Phase = journalPhaseUndo
+		if dbc.writeJournal(dbq, jpath, entry) != nil ||
+			dbc.undoTxOps(dbq, ops) != nil {
+			return err
+		}
+		dbq.PurgeFile(jpath)
+		return err
+	}
+	return dbq.PurgeFile(jpath)
+}
+
+// discard staged operations
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return fmt.Errorf("%wtransaction already done", ErrError)
+	}
+	tx.done = true
+	tx.ops = nil
+	return nil
+}
+
+func (tx *Tx) stage(op txOp) error {
+	if tx.done {
+		return fmt.Errorf("%wtransaction already done", ErrError)
+	}
+	if err := tx.collection.checkKey(op.Key); err != nil {
+		return err
+	}
+	if op.Index != "" {
+		if err := tx.collection.checkIndexKey(op.Index); err != nil {
+			return err
+		}
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// apply transaction operations in order using query of the current
+// operation
+func (dbc *Collection) applyTxOps(dbq *Query, ops []txOp) error {
+	for _, op := range ops {
+		var err error
+		switch op.Op {
+		case txSet:
+			err = dbq.Set(op.Key, op.Value)
+		case txDelete:
+			err = dbq.Delete(op.Key)
+		case txMark:
+			ix := dbc.Index(op.Index)
+			err = ix.mark(ix.query(dbq.FileEngine), op.Key)
+		case txClear:
+			ix := dbc.Index(op.Index)
+			err = ix.clear(ix.query(dbq.FileEngine), op.Key)
+		default:
+			err = fmt.Errorf("%winvalid transaction op: %s", ErrError, op.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get copy of transaction operations holding the current state of keys
+func (dbc *Collection) txStates(dbq *Query, ops []txOp) ([]txOp, error) {
+	res := make([]txOp, len(ops))
+	for i, op := range ops {
+		switch op.Op {
+		case txSet, txDelete:
+			rawdata, err := dbq.readKey(op.Key, func([]byte) error { return nil })
+			if err != nil && !errors.Is(err, ErrNotExist) {
+				return nil, err
+			}
+			op.Exist, op.Prev = err == nil, rawdata
+		case txMark, txClear:
+			op.Exist = dbc.Index(op.Index).Check(op.Key)
+		}
+		res[i] = op
+	}
+	return res, nil
+}
+
+// undo transaction operations in reverse order restoring the state of
+// keys before the transaction
+func (dbc *Collection) undoTxOps(dbq *Query, ops []txOp) error {
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		var err error
+		switch op.Op {
+		case txSet, txDelete:
+			if op.Exist {
+				err = dbq.write(op.Key, op.Prev)
+			} else if dbq.IsExist(op.Key) {
+				err = dbq.Delete(op.Key)
+			}
+		case txMark, txClear:
+			ix := dbc.Index(op.Index)
+			if op.Exist {
+				err = ix.mark(ix.query(dbq.FileEngine), op.Key)
+			} else {
+				err = ix.clear(ix.query(dbq.FileEngine), op.Key)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
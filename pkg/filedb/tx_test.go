@@ -0,0 +1,185 @@
+package filedb
+
+import (
+	"testing"
+)
+
+func TestTxCommitAndRollback(t *testing.T) {
+	tests := []struct {
+		name   string
+		commit bool
+		value  string
+		marked bool
+	}{
+		{"commit", true, "new", true},
+		{"rollback", false, "old", false},
+	}
+	for _, tt := range tests {
+		dbc, _ := newMemCollection(t, nil)
+		q := dbc.Query()
+		q.Set("k", []byte("old"))
+		q.Set("d", []byte("d"))
+
+		tx, err := dbc.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Set("k", []byte("new"))
+		tx.Delete("d")
+		tx.Mark("ix", "k")
+		// staged operations are visible to the transaction only
+		if value, err := tx.Get("k"); err != nil || string(value) != "new" {
+			t.Errorf("%s: expected staged value, got %q %v", tt.name, value, err)
+		}
+		if _, err := tx.Get("d"); err != ErrNotExist {
+			t.Errorf("%s: expected staged delete, got %v", tt.name, err)
+		}
+		if value, _ := q.Get("k"); string(value) != "old" {
+			t.Errorf("%s: staged value visible before commit", tt.name)
+		}
+
+		if tt.commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := q.Get("k"); string(value) != tt.value {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.value, value)
+		}
+		if q.IsExist("d") == tt.commit {
+			t.Errorf("%s: unexpected deleted key state", tt.name)
+		}
+		if dbc.Index("ix").Check("k") != tt.marked {
+			t.Errorf("%s: unexpected index mark state", tt.name)
+		}
+		if tx.Commit() == nil || tx.Rollback() == nil {
+			t.Errorf("%s: expected done transaction errors", tt.name)
+		}
+	}
+}
+
+func TestTxRecover(t *testing.T) {
+	dbc, st := newMemCollection(t, nil)
+	q := dbc.Query()
+	q.Set("a", []byte("old"))
+	q.Set("b", []byte("b"))
+
+	// journal of transaction interrupted before its ops were applied
+	entry := &journalEntry{Type: journalTx, Ops: []txOp{
+		{Op: txSet, Key: "a", Value: []byte("new")},
+		{Op: txDelete, Key: "b"},
+		{Op: txMark, Key: "a", Index: "ix"},
+	}}
+	st.MkdirAll(dbc.journalPath(""), 0o775)
+	if err := dbc.writeJournal(q, dbc.newJournalPath(journalTx), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dbc.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := q.Get("a"); string(value) != "new" {
+		t.Errorf("expected replayed value, got %q", value)
+	}
+	if q.IsExist("b") {
+		t.Error("expected replayed delete")
+	}
+	if !dbc.Index("ix").Check("a") {
+		t.Error("expected replayed index mark")
+	}
+	entries, _ := st.ReadDir(dbc.journalPath(""))
+	if len(entries) != 0 {
+		t.Errorf("expected empty journal, got %d entries", len(entries))
+	}
+}
+
+func TestRecoverWaitsForCommit(t *testing.T) {
+	dbc, _ := newMemCollection(t, nil)
+	dbc.Query().Set("k", []byte("v"))
+
+	// commits hold the collection lock shared while their journal entry
+	// exists, so Recover must not get the exclusive lock meanwhile
+	dbe := dbc.Query().FileEngine
+	release, err := dbc.lockChain(dbe, dbc.base_path, lockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	c := dbc.sub(dbc.base_path)
+	q := c.Query()
+	q.OpTimeout, q.OpPolling = 0.2, 0.05
+	if err := c.withTreeLock(q.FileEngine, c.recoverJournal); err != ErrTimeout {
+		t.Errorf("expected lock timeout, got %v", err)
+	}
+}
+
+func TestTxCommitFailureUndone(t *testing.T) {
+	dbc, st := newMemCollection(t, nil)
+	q := dbc.Query()
+	q.Set("a", []byte("old"))
+	q.Set("d", []byte("d"))
+	q.Set("f", []byte("file"))
+	dbc.Index("ix").Mark("m")
+
+	tx, _ := dbc.Begin()
+	tx.Set("a", []byte("new"))
+	tx.Set("n", []byte("new"))
+	tx.Delete("d")
+	tx.Mark("ix", "a")
+	tx.Clear("ix", "m")
+	// key dir is a file so the write fails
+	tx.Set("f.x", []byte("x"))
+	if err := tx.Commit(); err == nil {
+		t.Fatal("expected commit error")
+	}
+
+	if value, _ := q.Get("a"); string(value) != "old" {
+		t.Errorf("expected restored value, got %q", value)
+	}
+	if q.IsExist("n") || !q.IsExist("d") {
+		t.Error("expected keys state before transaction")
+	}
+	if dbc.Index("ix").Check("a") || !dbc.Index("ix").Check("m") {
+		t.Error("expected index marks before transaction")
+	}
+	if entries, _ := st.ReadDir(dbc.journalPath("")); len(entries) != 0 {
+		t.Errorf("expected empty journal, got %d entries", len(entries))
+	}
+	if err := dbc.Recover(); err != nil {
+		t.Errorf("unexpected recover error %v", err)
+	}
+}
+
+func TestTxRecoverUndo(t *testing.T) {
+	dbc, st := newMemCollection(t, nil)
+	q := dbc.Query()
+	q.Set("a", []byte("new"))
+	q.Set("n", []byte("new"))
+
+	// journal of failed commit interrupted while undoing its ops
+	entry := &journalEntry{Type: journalTx, Phase: journalPhaseUndo, Ops: []txOp{
+		{Op: txSet, Key: "a", Value: []byte("new"), Exist: true, Prev: []byte("old")},
+		{Op: txSet, Key: "n", Value: []byte("new")},
+		{Op: txDelete, Key: "d", Exist: true, Prev: []byte("d")},
+	}}
+	st.MkdirAll(dbc.journalPath(""), 0o775)
+	if err := dbc.writeJournal(q, dbc.newJournalPath(journalTx), entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbc.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := q.Get("a"); string(value) != "old" {
+		t.Errorf("expected undone value, got %q", value)
+	}
+	if value, _ := q.Get("d"); string(value) != "d" {
+		t.Errorf("expected undone delete, got %q", value)
+	}
+	if q.IsExist("n") {
+		t.Error("expected undone new key")
+	}
+}
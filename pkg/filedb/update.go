@@ -0,0 +1,74 @@
+package filedb
+
+import (
+	"github.com/exonlabs/go-utils/pkg/types"
+)
+
+// atomic read-modify-write of key value holding the key exclusive lock
+// for the whole cycle. fn receives nil if the key does not exist, the
+// key is not changed if fn returns error.
+func (dbq *Query) Update(
+	key string, fn func([]byte) ([]byte, error)) error {
+	return dbq.withKeyLock(key, func(q *Query) error {
+		value, err := q.Get(key)
+		if err != nil && err != ErrNotExist {
+			return err
+		}
+		value, err = fn(value)
+		if err != nil {
+			return err
+		}
+		return q.Set(key, value)
+	})
+}
+func (dbq *Query) UpdateBuffer(key string, fn func(Buffer) error) error {
+	return dbq.withKeyLock(key, func(q *Query) error {
+		value, err := q.GetBuffer(key)
+		if err == ErrNotExist {
+			value = types.NewNDict(map[string]any{})
+		} else if err != nil {
+			return err
+		}
+		if err := fn(value); err != nil {
+			return err
+		}
+		return q.SetBuffer(key, value)
+	})
+}
+
+// atomic read-modify-write of encrypted key value
+func (dbq *Query) UpdateSecure(
+	key string, fn func([]byte) ([]byte, error)) error {
+	if dbq.collection.cipher == nil {
+		return ErrNoSecurity
+	}
+	return dbq.withKeyLock(key, func(q *Query) error {
+		value, err := q.GetSecure(key)
+		if err != nil && err != ErrNotExist {
+			return err
+		}
+		value, err = fn(value)
+		if err != nil {
+			return err
+		}
+		return q.SetSecure(key, value)
+	})
+}
+func (dbq *Query) UpdateSecureBuffer(
+	key string, fn func(Buffer) error) error {
+	if dbq.collection.cipher == nil {
+		return ErrNoSecurity
+	}
+	return dbq.withKeyLock(key, func(q *Query) error {
+		value, err := q.GetSecureBuffer(key)
+		if err == ErrNotExist {
+			value = types.NewNDict(map[string]any{})
+		} else if err != nil {
+			return err
+		}
+		if err := fn(value); err != nil {
+			return err
+		}
+		return q.SetSecureBuffer(key, value)
+	})
+}
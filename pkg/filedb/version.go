@@ -0,0 +1,130 @@
+package filedb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/exonlabs/go-utils/pkg/types"
+)
+
+// key versions are tokens derived from the hash of the stored value,
+// the version of a non existing key is the empty string.
+
+// read key value with its version token
+func (dbq *Query) GetWithVersion(key string) ([]byte, string, error) {
+	var data []byte
+	err := dbq.read(key, func(b []byte) error {
+		data = b
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return data, valueVersion(data), nil
+}
+func (dbq *Query) GetBufferWithVersion(key string) (Buffer, string, error) {
+	var data map[string]any
+	var version string
+	err := dbq.read(key, func(b []byte) error {
+		data = nil
+		if err := json.Unmarshal(b, &data); err != nil {
+			return err
+		}
+		version = valueVersion(b)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return types.NewNDict(data), version, nil
+}
+
+// write key value only if the stored version matches, an empty version
+// only succeeds if the key does not exist. ErrConflict is returned if
+// the key was changed since the version was read.
+func (dbq *Query) SetIfVersion(key string, value []byte, version string) error {
+	return dbq.withKeyLock(key, func(q *Query) error {
+		current, err := q.version(key)
+		if err != nil {
+			return err
+		}
+		if current != version {
+			return ErrConflict
+		}
+		return q.Set(key, value)
+	})
+}
+func (dbq *Query) SetBufferIfVersion(
+	key string, value Buffer, version string) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w - %s", ErrWrite, err.Error())
+	}
+	return dbq.SetIfVersion(key, data, version)
+}
+
+// get current version of key value
+func (dbq *Query) version(key string) (string, error) {
+	var version string
+	err := dbq.read(key, func(b []byte) error {
+		version = valueVersion(b)
+		return nil
+	})
+	if err == ErrNotExist {
+		return "", nil
+	}
+	return version, err
+}
+
+// run fn holding exclusive lock on key, writes done by the query passed
+// to fn don't lock the key again
+func (dbq *Query) withKeyLock(key string, fn func(*Query) error) error {
+	return dbq.withKeysLock([]*Collection{dbq.collection}, []string{key},
+		func(dbe *FileEngine) error {
+			return fn(&Query{FileEngine: dbe, collection: dbq.collection})
+		})
+}
+
+// run fn holding the dir locks of keys in their respective collections,
+// dirs are locked in sorted order so concurrent operations on the same
+// dirs never deadlock.
+func (dbq *Query) withKeysLock(collections []*Collection, keys []string,
+	fn func(*FileEngine) error) error {
+	dirs := make([]string, 0, len(keys))
+	for i, key := range keys {
+		dbc := collections[i]
+		if err := dbc.checkKey(key); err != nil {
+			return err
+		}
+		dirpath := filepath.Dir(dbc.keyPath(key))
+		release, err := dbc.lockChain(dbq.FileEngine, dirpath, lockShared)
+		if err != nil {
+			return err
+		}
+		defer release()
+		dirs = append(dirs, dirpath)
+	}
+	slices.Sort(dirs)
+	dirs = slices.Compact(dirs)
+
+	var lockDirs func(dbe *FileEngine, dirs []string) error
+	lockDirs = func(dbe *FileEngine, dirs []string) error {
+		if len(dirs) == 0 {
+			return fn(dbe)
+		}
+		return dbe.WithDirLock(dirs[0], func(e *FileEngine) error {
+			return lockDirs(e, dirs[1:])
+		})
+	}
+	return lockDirs(dbq.FileEngine, dirs)
+}
+
+// calc version token of value
+func valueVersion(value []byte) string {
+	h := sha256.Sum256(value)
+	return hex.EncodeToString(h[:16])
+}
@@ -0,0 +1,63 @@
+package filedb
+
+import (
+	"testing"
+)
+
+func TestSetIfVersion(t *testing.T) {
+	dbc, _ := newMemCollection(t, nil)
+	q := dbc.Query()
+	q.Set("k", []byte("v1"))
+	_, v1, err := q.GetWithVersion("k")
+	if err != nil || v1 == "" {
+		t.Fatalf("expected version, got %q %v", v1, err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		version string
+		err     error
+	}{
+		{"new key with empty version", "n", "", nil},
+		{"existing key with empty version", "k", "", ErrConflict},
+		{"stale version", "k", "0123", ErrConflict},
+		{"current version", "k", v1, nil},
+		{"replaced version", "k", v1, ErrConflict},
+		{"missing key with version", "m", v1, ErrConflict},
+	}
+	for _, tt := range tests {
+		err := q.SetIfVersion(tt.key, []byte("v2"), tt.version)
+		if err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	value, v2, err := q.GetWithVersion("k")
+	if err != nil || string(value) != "v2" || v2 == v1 {
+		t.Errorf("expected new value and version, got %q %q %v", value, v2, err)
+	}
+}
+
+func TestBufferVersion(t *testing.T) {
+	dbc, _ := newMemCollection(t, Options{"checksum": true})
+	q := dbc.Query()
+	if err := q.SetBufferIfVersion("k", Buffer{"n": 1}, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := q.GetBufferWithVersion("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// versions of raw and buffer reads of the same value match
+	if _, v, _ := q.GetWithVersion("k"); v != version {
+		t.Errorf("expected matching versions, got %q %q", v, version)
+	}
+	b := Buffer{"n": 2}
+	if err := q.SetBufferIfVersion("k", b, version); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SetBufferIfVersion("k", b, version); err != ErrConflict {
+		t.Errorf("expected conflict, got %v", err)
+	}
+}
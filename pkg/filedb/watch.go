@@ -0,0 +1,45 @@
+package filedb
+
+import (
+	"strings"
+)
+
+// watch event types
+const (
+	WatchCreated = "created"
+	WatchUpdated = "updated"
+	WatchDeleted = "deleted"
+	// events were lost by the kernel queue overflow, consumers should
+	// resync their state of the collection
+	WatchOverflow = "overflow"
+)
+
+// watch options:
+//
+//	recursive: bool  also watch child collections and nested keys
+//	                 (default false)
+//	indexes:   bool  also report index mark and clear events
+//	                 (default false)
+//	buffer:    int   events channel buffer size (default 64)
+
+// WatchEvent describes a change of key or index entry in a watched
+// collection, changes of internal files like backups, legacy backups,
+// temp files and journal entries are not reported.
+type WatchEvent struct {
+	// event type, one of WatchCreated, WatchUpdated, WatchDeleted or
+	// WatchOverflow which has no key
+	Type string
+	// decoded key name
+	Key string
+	// decoded names of child collections holding the key relative to
+	// the watched collection, empty for keys of the watched collection
+	Childs []string
+	// index name for index events, empty for key events
+	Index string
+}
+
+// get key relative to watched collection joining child collections
+// names, only meaningful for collections without key encoding
+func (e WatchEvent) FullKey() string {
+	return strings.Join(append(append([]string{}, e.Childs...), e.Key), keySep)
+}
@@ -0,0 +1,292 @@
+//go:build linux
+
+package filedb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_DELETE | unix.IN_CREATE | unix.IN_DELETE_SELF | unix.IN_ONLYDIR
+
+// watch collection for changes made by any process using inotify, the
+// returned channel is closed when ctx is done. only the filesystem
+// storage backend is supported. keys are written by atomic renames so
+// created and updated events are told apart by tracking known keys.
+// keys found in dirs created while watching are reported as created,
+// keys created and deleted before the new dir is watched are missed.
+func (dbc *Collection) Watch(
+	ctx context.Context, opts Options) (<-chan WatchEvent, error) {
+	if dbc.keyErr != nil {
+		return nil, dbc.keyErr
+	}
+	if _, ok := dbc.storage.(*OsStorage); !ok {
+		return nil, fmt.Errorf(
+			"%wwatch is only supported by filesystem storage", ErrError)
+	}
+	if !dbc.IsExist() {
+		return nil, ErrNotExist
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+	w := &watcher{
+		dbc:       dbc,
+		ctx:       ctx,
+		fd:        fd,
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		recursive: opts.GetBool("recursive", false),
+		indexes:   opts.GetBool("indexes", false),
+		dirs:      map[int]*watchDir{},
+		events:    make(chan WatchEvent, opts.GetInt("buffer", 64)),
+	}
+	if err := w.addDir(&watchDir{path: dbc.base_path}, false); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		w.file.Close()
+	}()
+	go w.run()
+	return w.events, nil
+}
+
+type watcher struct {
+	dbc       *Collection
+	ctx       context.Context
+	fd        int
+	file      *os.File
+	recursive bool
+	indexes   bool
+	dirs      map[int]*watchDir
+	events    chan WatchEvent
+}
+
+// watched dir of collection, child collection or index
+type watchDir struct {
+	path   string
+	childs []string
+	index  string
+	// known key file names
+	keys map[string]bool
+}
+
+// add watch on dir then scan its keys and sub dirs, events for existing
+// keys are emitted for dirs created after watch started
+func (w *watcher) addDir(d *watchDir, emit bool) error {
+	wd, err := unix.InotifyAddWatch(w.fd, d.path, watchMask)
+	if err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+	d.keys = map[string]bool{}
+	w.dirs[wd] = d
+
+	entries, err := w.dbc.storage.ReadDir(d.path)
+	if err != nil {
+		return fmt.Errorf("%w%s", ErrError, err.Error())
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if sub, ok := w.subDir(d, e.Name()); ok {
+				if err := w.addDir(sub, emit); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		key, ok := w.keyName(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		d.keys[e.Name()] = true
+		if emit {
+			w.emit(d, WatchCreated, key)
+		}
+	}
+	return nil
+}
+
+// get watched sub dir of dir, only child collections and index dirs
+// are watched depending on options
+func (w *watcher) subDir(d *watchDir, name string) (*watchDir, bool) {
+	path := filepath.Join(d.path, name)
+	switch {
+	case d.index != "":
+		if strings.HasPrefix(name, ".") {
+			return nil, false
+		}
+		return &watchDir{
+			path: path, childs: d.childs, index: d.index + keySep + name,
+		}, true
+	case strings.HasPrefix(name, ".ix_"):
+		if !w.indexes {
+			return nil, false
+		}
+		return &watchDir{
+			path:   path,
+			childs: d.childs,
+			index:  strings.TrimPrefix(name, ".ix_"),
+		}, true
+	case w.recursive:
+		key, ok := w.dbc.nameKey(name)
+		if !ok {
+			return nil, false
+		}
+		return &watchDir{
+			path: path, childs: append(slices.Clone(d.childs), key),
+		}, true
+	}
+	return nil, false
+}
+
+// remove watches of dir and all watched dirs under it, deleted events
+// are emitted for their known keys
+func (w *watcher) removeDir(path string) {
+	for wd, d := range w.dirs {
+		if d.path != path && !strings.HasPrefix(d.path, path+fileSep) {
+			continue
+		}
+		for name := range d.keys {
+			if key, ok := w.keyName(name); ok {
+				w.emit(d, WatchDeleted, key)
+			}
+		}
+		unix.InotifyRmWatch(w.fd, uint32(wd))
+		delete(w.dirs, wd)
+	}
+}
+
+// read and dispatch inotify events until the watcher file is closed
+func (w *watcher) run() {
+	defer close(w.events)
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += unix.SizeofInotifyEvent
+			name := strings.TrimRight(
+				string(buf[off:off+int(ev.Len)]), "\x00")
+			off += int(ev.Len)
+			w.handle(int(ev.Wd), ev.Mask, name)
+		}
+	}
+}
+
+func (w *watcher) handle(wd int, mask uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		w.emit(&watchDir{}, WatchOverflow, "")
+		w.resync()
+		return
+	}
+	d, ok := w.dirs[wd]
+	if !ok {
+		return
+	}
+	if mask&(unix.IN_DELETE_SELF|unix.IN_IGNORED) != 0 {
+		delete(w.dirs, wd)
+		return
+	}
+
+	if mask&unix.IN_ISDIR != 0 {
+		switch {
+		case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+			if sub, ok := w.subDir(d, name); ok {
+				w.addDir(sub, true)
+			}
+		case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+			w.removeDir(filepath.Join(d.path, name))
+		}
+		return
+	}
+
+	key, ok := w.keyName(name)
+	if !ok {
+		return
+	}
+	switch {
+	case mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0:
+		typ := WatchCreated
+		if d.keys[name] {
+			typ = WatchUpdated
+		}
+		d.keys[name] = true
+		w.emit(d, typ, key)
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		if d.keys[name] {
+			delete(d.keys, name)
+			w.emit(d, WatchDeleted, key)
+		}
+	}
+}
+
+// rescan watched dirs after lost events, known keys are reloaded and new
+// sub dirs are watched without emitting events
+func (w *watcher) resync() {
+	dirs := make([]*watchDir, 0, len(w.dirs))
+	for _, d := range w.dirs {
+		dirs = append(dirs, d)
+	}
+	for _, d := range dirs {
+		entries, err := w.dbc.storage.ReadDir(d.path)
+		if err != nil {
+			continue
+		}
+		d.keys = map[string]bool{}
+		for _, e := range entries {
+			if e.IsDir() {
+				sub, ok := w.subDir(d, e.Name())
+				if ok && !w.isWatched(sub.path) {
+					w.addDir(sub, false)
+				}
+				continue
+			}
+			if _, ok := w.keyName(e.Name()); ok && e.Type().IsRegular() {
+				d.keys[e.Name()] = true
+			}
+		}
+	}
+}
+
+// check if dir path is watched
+func (w *watcher) isWatched(path string) bool {
+	for _, d := range w.dirs {
+		if d.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// get key of file name, internal and legacy backup files are rejected
+func (w *watcher) keyName(name string) (string, bool) {
+	if w.dbc.isLegacyBak(name) {
+		return "", false
+	}
+	return w.dbc.nameKey(name)
+}
+
+// send event unless watch is done
+func (w *watcher) emit(d *watchDir, typ, key string) {
+	select {
+	case w.events <- WatchEvent{
+		Type: typ, Key: key, Childs: d.childs, Index: d.index}:
+	case <-w.ctx.Done():
+	}
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package filedb
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// read events until no event is received for a while
+func readEvents(events <-chan WatchEvent) []string {
+	res := []string{}
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return append(res, "closed")
+			}
+			res = append(res, strings.TrimSpace(
+				fmt.Sprintf("%s %s %s", e.Type, e.FullKey(), e.Index)))
+		case <-time.After(200 * time.Millisecond):
+			return res
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"keys", nil, []string{
+			"created k", "updated k", "deleted k"}},
+		{"recursive", Options{"recursive": true}, []string{
+			"created k", "updated k", "created c.x", "deleted k"}},
+		{"indexes", Options{"indexes": true}, []string{
+			"created k", "updated k", "created k ix", "deleted k"}},
+	}
+	for _, tt := range tests {
+		dbc, err := NewCollection(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbc.UpdateOptions(Options{"backup_generations": 2})
+		dbc.Query().Set("old", []byte("v"))
+		dbc.Child("c").Query().Set("old", []byte("v"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := dbc.Watch(ctx, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := dbc.Query()
+		q.Set("k", []byte("1"))
+		q.Set("k", []byte("2"))
+		dbc.Child("c").Query().Set("x", []byte("1"))
+		dbc.Index("ix").Mark("k")
+		q.Delete("k")
+
+		if got := readEvents(events); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected events %v, got %v", tt.name, tt.want, got)
+		}
+		cancel()
+		if got := readEvents(events); !slices.Equal(got, []string{"closed"}) {
+			t.Errorf("%s: expected closed channel, got %v", tt.name, got)
+		}
+	}
+}
+
+func TestWatchUnsupported(t *testing.T) {
+	dbc, _ := newMemCollection(t, nil)
+	dbc.Query().Set("k", []byte("v"))
+	if _, err := dbc.Watch(context.Background(), nil); err == nil {
+		t.Error("expected error for memory storage")
+	}
+	dbc, _ = NewCollection(t.TempDir() + "/missing")
+	if _, err := dbc.Watch(context.Background(), nil); err != ErrNotExist {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package filedb
+
+import (
+	"context"
+	"fmt"
+)
+
+// watch collection for changes, only supported on linux
+func (dbc *Collection) Watch(
+	ctx context.Context, opts Options) (<-chan WatchEvent, error) {
+	return nil, fmt.Errorf("%wwatch is not supported on this platform", ErrError)
+}